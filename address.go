@@ -0,0 +1,157 @@
+package gostun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+/*
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |0 0 0 0 0 0 0 0|    Family     |           Port                |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |                                                               |
+   |                 Address (32 bits or 128 bits)                 |
+   |                                                               |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+               Format of MAPPED-ADDRESS Attribute
+*/
+
+// MAPPED-ADDRESS, used by RFC 3489 servers
+type MappedAddress Addr
+
+func (addr MappedAddress) String() string {
+	return fmt.Sprintf("IP: %s\nPort:%s", addr.IP.String(), strconv.Itoa(addr.Port))
+}
+
+func (addr *MappedAddress) AddTo(m *Message) error {
+	return (*Addr)(addr).encodeAddr(m, MAPPED_ADDRESS)
+}
+
+func (addr *MappedAddress) GetFrom(m *Message) error {
+	return (*Addr)(addr).decodeAddr(m, MAPPED_ADDRESS)
+}
+
+// CHANGED-ADDRESS of RFC 3489 servers, the address which responds to CHANGE-REQUEST.
+// it is different from OTHER-ADDRESS of RFC 5780
+type ChangedAddress Addr
+
+func (addr ChangedAddress) String() string {
+	return fmt.Sprintf("IP: %s\nPort:%s", addr.IP.String(), strconv.Itoa(addr.Port))
+}
+
+func (addr *ChangedAddress) AddTo(m *Message) error {
+	return (*Addr)(addr).encodeAddr(m, CHANGED_ADDRESS)
+}
+
+func (addr *ChangedAddress) GetFrom(m *Message) error {
+	return (*Addr)(addr).decodeAddr(m, CHANGED_ADDRESS)
+}
+
+// RESPONSE-ADDRESS of RFC 3489 requests, the server sends the response to it
+// instead of the source address of the request. it is only added to requests
+type ResponseAddress Addr
+
+func (addr ResponseAddress) String() string {
+	return fmt.Sprintf("IP: %s\nPort:%s", addr.IP.String(), strconv.Itoa(addr.Port))
+}
+
+func (addr *ResponseAddress) AddTo(m *Message) error {
+	return (*Addr)(addr).encodeAddr(m, RESPONSE_ADDRESS)
+}
+
+// SOURCE-ADDRESS of RFC 3489 responses, the address which the server sent the response from.
+// it is only decoded from responses
+type SourceAddress Addr
+
+func (addr SourceAddress) String() string {
+	return fmt.Sprintf("IP: %s\nPort:%s", addr.IP.String(), strconv.Itoa(addr.Port))
+}
+
+func (addr *SourceAddress) GetFrom(m *Message) error {
+	return (*Addr)(addr).decodeAddr(m, SOURCE_ADDRESS)
+}
+
+// reflexive address of the Binding response, XOR-MAPPED-ADDRESS, MAPPED-ADDRESS and
+// XOR-MAPPED-ADDRESS of the old servers are tried in the order. the first one which is
+// decoded is returned as *net.UDPAddr, otherwise the error of the first malformed one
+func (m *Message) ReflexiveAddress() (net.Addr, error) {
+	var (
+		addr     Addr
+		firstErr error
+	)
+	decoders := []func() error{
+		func() error { return (*xorAddr)(&addr).decode(m, XOR_MAPPED_ADDRESS) },
+		func() error { return addr.decodeAddr(m, MAPPED_ADDRESS) },
+		func() error { return (*xorAddr)(&addr).decode(m, XOR_MAPPED_ADDRESS_LEGACY) },
+	}
+	for _, decode := range decoders {
+		err := decode()
+		if err == nil {
+			return &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
+		}
+		if err != ErrAttributeNotFound && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, ErrAttributeNotFound
+}
+
+// add the address attribute of attrtype to m without XOR'ing
+func (addr *Addr) encodeAddr(m *Message, attrtype AttributeType) error {
+	family, ip, err := familyIP(addr.IP)
+	if err != nil {
+		return err
+	}
+
+	val := make([]byte, 4+len(ip))
+	putU16(val, 0, family)
+	putU16(val, 2, uint16(addr.Port))
+	copy(val[4:], ip)
+
+	return m.Add(attrtype, val)
+}
+
+// decode the address attribute of attrtype in m
+func (addr *Addr) decodeAddr(m *Message, attrtype AttributeType) error {
+	val, err := m.GetRapped(attrtype)
+	if err != nil {
+		return err
+	}
+	if len(val) < 4 {
+		err := fmt.Sprintf("address length(%d) is less than 4", len(val))
+		return errors.New(err)
+	}
+
+	family, err := getU16(val, 0)
+	if err != nil {
+		return err
+	}
+	port, err := getU16(val, 2)
+	if err != nil {
+		return err
+	}
+	ipl, err := familyLen(family)
+	if err != nil {
+		return err
+	}
+	if len(val[4:]) != ipl {
+		err := fmt.Sprintf("address length(%d) disagrees with family %d", len(val[4:]), family)
+		return errors.New(err)
+	}
+
+	addr.Port = int(port)
+	addr.IP = append(addr.IP[:0], val[4:]...)
+
+	return nil
+}
+
+// Deprecated: use XORMappedAddress, XORMappedAddr is its name before XOR-MAPPED-ADDRESS encoding
+type XORMappedAddr = XORMappedAddress
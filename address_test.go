@@ -0,0 +1,112 @@
+package gostun
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// the reflexive address of RFC 5769 section 2.3
+var testIPv6 = net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677")
+
+func TestXORMappedAddressIPv6(t *testing.T) {
+	m := MessageBuild(TransactionID, BindingSuccess, &XORMappedAddress{IP: testIPv6, Port: 32853})
+	d := &Message{Raw: append([]byte(nil), m.Raw...)}
+	if err := d.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := d.Get(XOR_MAPPED_ADDRESS); a.Length != 20 {
+		t.Fatalf("length is %d, want 20", a.Length)
+	}
+	var addr XORMappedAddress
+	if err := addr.GetFrom(d); err != nil {
+		t.Fatal(err)
+	}
+	if !addr.IP.Equal(testIPv6) || addr.Port != 32853 {
+		t.Fatalf("decoded %s port %d", addr.IP, addr.Port)
+	}
+}
+
+// XOR-MAPPED-ADDRESS of RFC 5769 section 2.3 is xored with the cookie and the transaction id
+func TestXORMappedAddressIPv6Vector(t *testing.T) {
+	b, err := hex.DecodeString(fuzzSeedHex[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Message{Raw: b}
+	if err := m.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	var addr XORMappedAddress
+	if err := addr.GetFrom(m); err != nil {
+		t.Fatal(err)
+	}
+	if !addr.IP.Equal(testIPv6) || addr.Port != 32853 {
+		t.Fatalf("decoded %s port %d", addr.IP, addr.Port)
+	}
+}
+
+// the plain address attributes share the encoding of MAPPED-ADDRESS
+func TestAddressIPv6(t *testing.T) {
+	for _, tc := range []struct {
+		typ AttributeType
+		add func(m *Message) error
+		get func(m *Message) (Addr, error)
+	}{
+		{
+			typ: MAPPED_ADDRESS,
+			add: (&MappedAddress{IP: testIPv6, Port: 3478}).AddTo,
+			get: func(m *Message) (Addr, error) {
+				var a MappedAddress
+				err := a.GetFrom(m)
+				return Addr(a), err
+			},
+		},
+		{
+			typ: ALTERNATE_SERVER,
+			add: (&AlternateServer{IP: testIPv6, Port: 3478}).AddTo,
+			get: func(m *Message) (Addr, error) {
+				var a AlternateServer
+				err := a.GetFrom(m)
+				return Addr(a), err
+			},
+		},
+		{
+			typ: XOR_PEER_ADDRESS,
+			add: (&XORPeerAddress{IP: testIPv6, Port: 3478}).AddTo,
+			get: func(m *Message) (Addr, error) {
+				var a XORPeerAddress
+				err := a.GetFrom(m)
+				return Addr(a), err
+			},
+		},
+		{
+			typ: XOR_RELAYED_ADDRESS,
+			add: (&XORRelayedAddress{IP: testIPv6, Port: 3478}).AddTo,
+			get: func(m *Message) (Addr, error) {
+				var a XORRelayedAddress
+				err := a.GetFrom(m)
+				return Addr(a), err
+			},
+		},
+	} {
+		m := MessageBuild(TransactionID, BindingSuccess)
+		if err := tc.add(m); err != nil {
+			t.Fatal(err)
+		}
+		d := &Message{Raw: append([]byte(nil), m.Raw...)}
+		if err := d.Decode(); err != nil {
+			t.Fatal(err)
+		}
+		if a, _ := d.Get(tc.typ); a.Length != 20 || a.Value[1] != 0x02 {
+			t.Fatalf("%s: length %d family %d, want 20 and IPv6", tc.typ, a.Length, a.Value[1])
+		}
+		addr, err := tc.get(d)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.typ, err)
+		}
+		if !addr.IP.Equal(testIPv6) || addr.Port != 3478 {
+			t.Fatalf("%s: decoded %s port %d", tc.typ, addr.IP, addr.Port)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package gostun
 
 import (
 	"errors"
+	"net"
 	"sync"
 	"time"
 )
@@ -13,29 +14,43 @@ import (
 */
 
 var (
-	ErrAgent              = errors.New("agent closed")
-	TransactionTimeOutErr = errors.New("transaction is timed out")
+	ErrAgent                = errors.New("agent closed")
+	TransactionTimeOutErr   = errors.New("transaction is timed out")
+	ErrTransactionStopped   = errors.New("transaction is stopped")
+	ErrTransactionNotExists = errors.New("transaction is not registered")
+	ErrTransactionExists    = errors.New("transaction exists with same id")
+	ErrTooManyTransactions  = errors.New("too many transactions")
+	ErrUnexpectedResponse   = errors.New("response type does not match the request")
 )
 
 // process of transaction in message
 type Agent struct {
-	transactions map[transactionID]TransactionAgent
-	mux          sync.Mutex
-	nonHandler   Handler // non-registered transactions
-	closed       bool
+	count   int64 // transactions of the shards by atomic, first for the alignment of 32-bit platforms
+	shards  [agentShards]*agentShard
+	mux     sync.RWMutex // guards the handlers, closed, logger, metrics, window, clock and max
+	closed  bool
+	logger  Logger // timed out transactions
+	metrics Metrics
+	window  time.Duration // duplicate responses of finished transactions are ignored in this
+	clock   Clock
+	max     int // max of the transactions, 0 is unlimited
+
+	// non-registered transactions
+	unmatchedResponseHandler Handler // responses, e.g. after the timeout
+	requestHandler           Handler // requests and indications from the peer
 }
 
 type transactionID [TransactionIDSize]byte //12byte, 96bit
 
 // transaction in progress
 type TransactionAgent struct {
-	ID      transactionID
-	Timeout time.Time
-	handler Handler // if transaction is succeed will be called
-}
-
-type AgentHandle struct {
-	handler Handler
+	ID         transactionID
+	Start      time.Time // time of Start, for RTT
+	Timeout    time.Time
+	Type       MessageType     // type of the request, the zero Method is not checked
+	UserData   interface{}     // passed to the events of the transaction, e.g. the candidate pair of ICE
+	handler    Handler         // if transaction is succeed will be called
+	retransmit *retransmission // nil, if the request is not re-sent
 }
 
 // reference http.HandlerFunc same work
@@ -43,73 +58,405 @@ type Handler interface {
 	HandleEvent(e MessageObj)
 }
 
+// event of the transaction, Err is set if the transaction is failed, e.g. TransactionTimeOutErr
 type MessageObj struct {
-	Msg *Message
-	Err error
+	Msg  *Message
+	From net.Addr      // source address of Msg, nil if it is unknown
+	RTT  time.Duration // from Start to the response, zero for the errors, non-registered and retransmitted transactions
+	Err  error
+
+	UserData interface{} // of Start, nil for the non-registered transactions
+
+	// send the response of Msg to From, set by Client.SetRequestHandler for the requests and indications
+	Respond func(m *Message) error
 }
 
+// the messages of non-registered transactions are dropped until SetHandler
 func NewAgent() *Agent {
-	h := AgentHandle{}
 	a := &Agent{
-		transactions: make(map[transactionID]TransactionAgent),
-		nonHandler:   h.handler,
+		metrics: nopMetrics{},
+		window:  defaultDuplicateWindow,
+		clock:   realClock{},
+	}
+	for i := range a.shards {
+		a.shards[i] = newAgentShard(&a.count)
 	}
 	return a
 }
 
-func (a *Agent) ProcessHandle(m *Message) error {
+func (a *Agent) shard(id transactionID) *agentShard {
+	return a.shards[shardIndex(id)]
+}
+
+// h is called with the messages of non-registered transactions, e.g. indications
+// and requests from the peer. nil drops them.
+// it sets both SetRequestHandler and SetUnmatchedResponseHandler
+func (a *Agent) SetHandler(h Handler) {
+	a.mux.Lock()
+	a.requestHandler = h
+	a.unmatchedResponseHandler = h
+	a.mux.Unlock()
+}
+
+// h is called with the requests and indications from the peer, nil drops them
+func (a *Agent) SetRequestHandler(h Handler) {
+	a.mux.Lock()
+	a.requestHandler = h
+	a.mux.Unlock()
+}
+
+// h is called with the responses of non-registered transactions, e.g. the late response
+// after the timeout, which means RTO is too short. nil drops them
+func (a *Agent) SetUnmatchedResponseHandler(h Handler) {
+	a.mux.Lock()
+	a.unmatchedResponseHandler = h
+	a.mux.Unlock()
+}
+
+// Start returns ErrTooManyTransactions when the agent has n transactions, 0 is unlimited.
+// Len is the current count of them
+func (a *Agent) SetMaxTransactions(n int) {
+	a.mux.Lock()
+	a.max = n
+	a.mux.Unlock()
+}
+
+// handlers and limits of an agent, which are not set by the options of Client
+type agentSettings struct {
+	requestHandler           Handler
+	unmatchedResponseHandler Handler
+	max                      int
+	window                   time.Duration
+}
+
+func (a *Agent) settings() agentSettings {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	return agentSettings{
+		requestHandler:           a.requestHandler,
+		unmatchedResponseHandler: a.unmatchedResponseHandler,
+		max:                      a.max,
+		window:                   a.window,
+	}
+}
+
+func (a *Agent) setSettings(s agentSettings) {
+	a.mux.Lock()
+	a.requestHandler = s.requestHandler
+	a.unmatchedResponseHandler = s.unmatchedResponseHandler
+	a.max = s.max
+	a.window = s.window
+	a.mux.Unlock()
+}
+
+// responses of the finished transactions are ignored for d, 0 passes them to the handler of SetUnmatchedResponseHandler
+func (a *Agent) SetDuplicateWindow(d time.Duration) {
+	a.mux.Lock()
+	a.window = d
+	a.mux.Unlock()
+}
+
+// register the transaction of id, h is called with the response or the error.
+// zero deadline means the transaction is not timed out.
+// userData is passed to h as MessageObj.UserData, e.g. to tell the transactions of h
+func (a *Agent) Start(id [TransactionIDSize]byte, deadline time.Time, h Handler, userData interface{}) error {
+	a.mux.RLock()
+	clk, max := a.clock, a.max
+	a.mux.RUnlock()
+
+	now := clk.Now()
+	s := a.shard(id)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.closed {
+		return ErrAgent
+	}
+
+	_, exist := s.transactions[id]
+	if exist {
+		return ErrTransactionExists // the registered handler is kept
+	}
+
+	tr := TransactionAgent{
+		ID:       id,
+		handler:  h,
+		Start:    now,
+		Timeout:  deadline,
+		UserData: userData,
+	}
+	if err := s.add(tr, max); err != nil {
+		return err
+	}
+	if !deadline.IsZero() {
+		s.deadlines.push(deadline, id)
+	}
+	a.getMetrics().TransactionStarted()
+
+	return nil
+}
+
+// the response of the transaction of id must be a response of the method of t,
+// other messages are delivered to the handler as ErrUnexpectedResponse
+func (a *Agent) SetRequestType(id [TransactionIDSize]byte, t MessageType) error {
+	s := a.shard(id)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.closed {
+		return ErrAgent
+	}
+	tr, ok := s.transactions[id]
+	if !ok {
+		return ErrTransactionNotExists
+	}
+	tr.Type = t
+	s.transactions[id] = tr
+	return nil
+}
+
+// the response of tr has the method of the request and a response class
+func (tr TransactionAgent) expects(t MessageType) bool {
+	if tr.Type.Method == 0 {
+		return true
+	}
+	if t.Method != tr.Type.Method {
+		return false
+	}
+	return t.Class == ClassSuccessResponse || t.Class == ClassErrorResponse
+}
+
+func (a *Agent) getMetrics() Metrics {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	return a.metrics
+}
+
+// from is the source address of m, if it is known.
+// the handler owns m, and m is released if no handler is called
+func (a *Agent) ProcessHandle(m *Message, from net.Addr) error {
 	e := MessageObj{
-		Msg: m,
+		Msg:  m,
+		From: from,
 	}
 
-	tr, ok := a.transactions[m.TransactionID]
-	delete(a.transactions, m.TransactionID) //delete maps entry
+	a.mux.RLock()
+	metrics, window, clk := a.metrics, a.window, a.clock
+	nonHandler := a.requestHandler
+	if m.IsResponse() {
+		nonHandler = a.unmatchedResponseHandler
+	}
+	a.mux.RUnlock()
 
+	now := clk.Now()
+	s := a.shard(m.TransactionID)
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		ReleaseMessage(m)
+		return ErrAgent
+	}
+	tr, ok := s.transactions[m.TransactionID]
+	// requests and indications of the same id, e.g. mirrored or spoofed, don't finish the transaction
+	ok = ok && m.IsResponse()
+	duplicate := false
+	retransmitted := ok && tr.retransmit != nil && tr.retransmit.retries > 0
 	if ok {
+		s.remove(m.TransactionID) //delete maps entry
+		s.finish(m.TransactionID, now, window)
+		s.compact()
+	} else if m.IsResponse() {
+		duplicate = s.isFinished(m.TransactionID, now, window)
+	}
+	s.mux.Unlock()
+
+	if ok && !tr.expects(m.Type) {
+		ReleaseMessage(m)
+		metrics.TransactionCompleted()
+		tr.handler.HandleEvent(MessageObj{
+			From:     from,
+			Err:      ErrUnexpectedResponse,
+			UserData: tr.UserData,
+		})
+	} else if ok {
+		if !retransmitted {
+			// the response of the retransmitted request can't be matched to one of them (Karn's rule)
+			e.RTT = now.Sub(tr.Start) // the tick of timeoutUntil is not used, it is too coarse
+		}
+		e.UserData = tr.UserData
+		metrics.TransactionCompleted()
 		tr.handler.HandleEvent(e) // HandleEvent implement
-	} else if a.nonHandler != nil {
-		a.nonHandler.HandleEvent(e) // the transaction is not registered
+	} else if duplicate {
+		ReleaseMessage(m) // e.g. response of the retransmitted request
+	} else if nonHandler != nil {
+		nonHandler.HandleEvent(e) // the transaction is not registered, dispatched by the class
+	} else {
+		ReleaseMessage(m)
 	}
 	return nil
 }
 
-/*
-The value for RTO SHOULD be cached by a client after the completion
-of the transaction, and used as the starting value for RTO for the
-next transaction to the same server (based on equality of IP
-address).
-*/
-
-//timeout したときに作動
+// timeout したときに作動
 func (a *Agent) TimeOutHandle(trate time.Time) error {
-	call := make([]Handler, 0, 100)
-	remove := make([]transactionID, 0, 100)
-	a.mux.Lock()
+	a.mux.RLock()
+	closed, l, metrics, window := a.closed, a.logger, a.metrics, a.window
+	a.mux.RUnlock()
+	if closed {
+		return ErrAgent
+	}
 
-	if a.closed {
-		a.mux.Unlock()
+	var (
+		call   []TransactionAgent
+		remove []transactionID
+	)
+	for _, s := range a.shards {
+		s.mux.Lock()
+		for {
+			t, ok := s.deadlines.popBefore(trate)
+			if !ok {
+				break
+			}
+			tr, ok := s.transactions[t.id]
+			if !ok {
+				continue // finished transaction
+			}
+			// zero Timeout means no deadline, e.g. DoContext without ctx deadline
+			timeout := !tr.Timeout.IsZero() && tr.Timeout.Before(trate)
+			if timeout || (tr.retransmit != nil && tr.retransmit.exhausted(trate)) {
+				call = append(call, tr)
+				remove = append(remove, t.id)
+				s.remove(t.id)
+				s.finish(t.id, trate, window) // the response may come late
+			}
+		}
+		s.mux.Unlock()
+	}
+
+	for range remove {
+		metrics.TransactionTimedOut()
+	}
+	if l != nil {
+		for _, id := range remove {
+			l.LogEvent(LogEvent{Kind: LogTransactionTimeout, ID: id})
+		}
+	}
+	// return transactions
+	for _, tr := range call {
+		tr.handler.HandleEvent(MessageObj{
+			Err:      TransactionTimeOutErr,
+			UserData: tr.UserData,
+		})
+	}
+
+	return nil
+}
+
+// cancel the transaction of id, its handler is called with ErrTransactionStopped
+func (a *Agent) Stop(id [TransactionIDSize]byte) error {
+	return a.CancelHandle(id, ErrTransactionStopped)
+}
+
+// remove the transaction of id and call its handler with err
+func (a *Agent) CancelHandle(id [TransactionIDSize]byte, err error) error {
+	a.mux.RLock()
+	metrics, window, clk := a.metrics, a.window, a.clock
+	a.mux.RUnlock()
+
+	now := clk.Now()
+	s := a.shard(id)
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
 		return ErrAgent
 	}
 
-	for i, tr := range a.transactions {
-		if tr.Timeout.Before(trate) {
-			call = append(call, tr.handler)
-			remove = append(remove, i)
+	tr, ok := s.transactions[id]
+	if ok {
+		s.remove(id)
+		s.finish(id, now, window)
+		s.compact()
+	}
+	s.mux.Unlock()
+
+	if !ok {
+		return ErrTransactionNotExists
+	}
+	metrics.TransactionCancelled()
+	tr.handler.HandleEvent(MessageObj{
+		Err:      err,
+		UserData: tr.UserData,
+	})
+
+	return nil
+}
+
+// cancel the transactions which pred reports true, their handlers are called with ErrTransactionStopped.
+// each shard is locked once while pred is called, so pred must not call a
+func (a *Agent) StopBy(pred func(id [TransactionIDSize]byte, t TransactionAgent) bool) {
+	a.mux.RLock()
+	metrics, window, clk := a.metrics, a.window, a.clock
+	a.mux.RUnlock()
+
+	now := clk.Now()
+	var call []TransactionAgent
+	for _, s := range a.shards {
+		s.mux.Lock()
+		if s.closed {
+			s.mux.Unlock()
+			continue
 		}
+		for id, tr := range s.transactions {
+			if !pred(id, tr) {
+				continue
+			}
+			call = append(call, tr)
+			s.remove(id)
+			s.finish(id, now, window)
+		}
+		s.compact()
+		s.mux.Unlock()
 	}
 
-	// no registered transactions
-	for _, id := range remove {
-		delete(a.transactions, id)
+	for _, tr := range call {
+		metrics.TransactionCancelled()
+		tr.handler.HandleEvent(MessageObj{
+			Err:      ErrTransactionStopped,
+			UserData: tr.UserData,
+		})
 	}
+}
 
+// close the agent, and call all registered handlers with ErrAgent.
+// after Close, Start, ProcessHandle and Close return ErrAgent
+func (a *Agent) Close() error {
+	a.mux.Lock()
+	if a.closed {
+		a.mux.Unlock()
+		return ErrAgent
+	}
+	a.closed = true
+	metrics := a.metrics
 	a.mux.Unlock()
-	e := MessageObj{
-		Err: TransactionTimeOutErr,
+
+	var call []TransactionAgent
+	for _, s := range a.shards {
+		s.mux.Lock()
+		s.closed = true
+		for id, tr := range s.transactions {
+			call = append(call, tr)
+			s.remove(id)
+		}
+		s.deadlines = nil
+		s.retransmits = nil
+		s.mux.Unlock()
 	}
-	// return transactions
-	for _, h := range call {
-		h.HandleEvent(e)
+
+	for _, tr := range call {
+		metrics.TransactionCancelled()
+		tr.handler.HandleEvent(MessageObj{
+			Err:      ErrAgent,
+			UserData: tr.UserData,
+		})
 	}
 
 	return nil
@@ -0,0 +1,361 @@
+package gostun
+
+import (
+	"encoding/hex"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Handler which records the events
+type eventHandler chan MessageObj
+
+func (h eventHandler) HandleEvent(e MessageObj) {
+	h <- e
+}
+
+// receive the event of h, fails if no event comes
+func (h eventHandler) next(t *testing.T) MessageObj {
+	t.Helper()
+	select {
+	case e := <-h:
+		return e
+	case <-time.After(time.Second * 5):
+		t.Fatal("no event")
+		return MessageObj{}
+	}
+}
+
+// fails if h has an event
+func (h eventHandler) none(t *testing.T) {
+	t.Helper()
+	select {
+	case e := <-h:
+		t.Fatalf("unexpected event: %+v", e)
+	default:
+	}
+}
+
+func TestAgentSetHandlerUnmatched(t *testing.T) {
+	a := NewAgent()
+	defer a.Close()
+	h := make(eventHandler, 1)
+	a.SetHandler(h)
+	m := &Message{TransactionID: [TransactionIDSize]byte{1}}
+	if err := m.Build(BindingSuccess); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ProcessHandle(m, nil); err != nil {
+		t.Fatal(err)
+	}
+	if e := h.next(t); e.Msg != m {
+		t.Fatalf("handler got %v, want %v", e.Msg, m)
+	}
+}
+
+// cost of one tick of timeoutUntil while 10k transactions are in flight
+func BenchmarkTimeOutHandle(b *testing.B) {
+	a := NewAgent()
+	defer a.Close()
+	a.SetMaxTransactions(0)
+	const n = 10000
+	now := time.Now()
+	h := make(eventHandler, n) // Close stops all of them
+	for i := 0; i < n; i++ {
+		var id [TransactionIDSize]byte
+		id[0], id[1] = byte(i), byte(i>>8)
+		if err := a.Start(id, now.Add(time.Hour+time.Duration(i)), h, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := a.TimeOutHandle(now); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// the second copy of the response is ignored, it doesn't reach the unmatched handler either
+func TestAgentDuplicateResponse(t *testing.T) {
+	a := NewAgent()
+	defer a.Close()
+	unmatched := make(eventHandler, 1)
+	a.SetHandler(unmatched)
+	h := make(eventHandler, 1)
+	id := [TransactionIDSize]byte{1}
+	if err := a.Start(id, time.Now().Add(time.Second*5), h, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		m := &Message{TransactionID: id}
+		if err := m.Build(BindingSuccess); err != nil {
+			t.Fatal(err)
+		}
+		a.ProcessHandle(m, nil)
+	}
+	if e := h.next(t); e.Err != nil {
+		t.Fatal(e.Err)
+	}
+	h.none(t)
+	unmatched.none(t)
+}
+
+// the response after the window is passed to the unmatched handler
+func TestAgentDuplicateWindow(t *testing.T) {
+	a := NewAgent()
+	defer a.Close()
+	clk := NewFakeClock(time.Unix(1000, 0))
+	a.SetClock(clk)
+	a.SetDuplicateWindow(time.Second)
+	unmatched := make(eventHandler, 1)
+	a.SetHandler(unmatched)
+	h := make(eventHandler, 1)
+	id := [TransactionIDSize]byte{1}
+	if err := a.Start(id, time.Time{}, h, nil); err != nil {
+		t.Fatal(err)
+	}
+	respond := func() {
+		m := &Message{TransactionID: id}
+		if err := m.Build(BindingSuccess); err != nil {
+			t.Fatal(err)
+		}
+		a.ProcessHandle(m, nil)
+	}
+	respond()
+	h.next(t)
+	clk.Advance(time.Second * 2)
+	respond()
+	unmatched.next(t)
+	h.none(t)
+}
+
+func TestAgentStartExists(t *testing.T) {
+	a := NewAgent()
+	defer a.Close()
+	first := make(eventHandler, 1)
+	second := make(eventHandler, 1)
+	id := [TransactionIDSize]byte{1}
+	deadline := time.Now().Add(time.Second * 5)
+	if err := a.Start(id, deadline, first, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Start(id, deadline, second, nil); err != ErrTransactionExists {
+		t.Fatalf("second Start returned %v, want %v", err, ErrTransactionExists)
+	}
+	m := &Message{TransactionID: id}
+	if err := m.Build(BindingSuccess); err != nil {
+		t.Fatal(err)
+	}
+	a.ProcessHandle(m, nil)
+	if e := first.next(t); e.Msg != m {
+		t.Fatalf("first handler got %v, want %v", e.Msg, m)
+	}
+	second.none(t)
+}
+
+// the response of the other method completes the transaction with ErrUnexpectedResponse
+func TestAgentUnexpectedResponse(t *testing.T) {
+	a := NewAgent()
+	defer a.Close()
+	h := make(eventHandler, 1)
+	id := [TransactionIDSize]byte{1}
+	if err := a.Start(id, time.Now().Add(time.Second*5), h, "data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetRequestType(id, BindingRequest); err != nil {
+		t.Fatal(err)
+	}
+	m := &Message{TransactionID: id}
+	if err := m.Build(NewMessageType(MethodAllocate, ClassSuccessResponse)); err != nil {
+		t.Fatal(err)
+	}
+	a.ProcessHandle(m, nil)
+	e := h.next(t)
+	if e.Err != ErrUnexpectedResponse {
+		t.Fatalf("err is %v, want %v", e.Err, ErrUnexpectedResponse)
+	}
+	if e.Msg != nil || e.UserData != "data" {
+		t.Fatalf("event is %+v", e)
+	}
+}
+
+// the request of the same id goes to the request handler, the transaction is kept
+func TestAgentRequestSameID(t *testing.T) {
+	a := NewAgent()
+	defer a.Close()
+	requests := make(eventHandler, 1)
+	a.SetRequestHandler(requests)
+	h := make(eventHandler, 1)
+	id := [TransactionIDSize]byte{1}
+	if err := a.Start(id, time.Now().Add(time.Second*5), h, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SetRequestType(id, BindingRequest); err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range []MessageType{BindingRequest, BindingIndication} {
+		m := &Message{TransactionID: id}
+		if err := m.Build(typ); err != nil {
+			t.Fatal(err)
+		}
+		a.ProcessHandle(m, nil)
+		if e := requests.next(t); e.Msg != m {
+			t.Fatalf("request handler got %v, want %v", e.Msg, m)
+		}
+		h.none(t)
+	}
+
+	m := &Message{TransactionID: id}
+	if err := m.Build(BindingSuccess); err != nil {
+		t.Fatal(err)
+	}
+	a.ProcessHandle(m, nil)
+	if e := h.next(t); e.Err != nil || e.Msg != m {
+		t.Fatalf("event is %+v", e)
+	}
+}
+
+// Metrics which counts the transactions by atomic
+type countMetrics struct {
+	started, completed, timedOut, cancelled int64
+}
+
+func (m *countMetrics) TransactionStarted()   { atomic.AddInt64(&m.started, 1) }
+func (m *countMetrics) TransactionCompleted() { atomic.AddInt64(&m.completed, 1) }
+func (m *countMetrics) TransactionTimedOut()  { atomic.AddInt64(&m.timedOut, 1) }
+func (m *countMetrics) TransactionCancelled() { atomic.AddInt64(&m.cancelled, 1) }
+func (m *countMetrics) BytesRead(int)         {}
+func (m *countMetrics) BytesWritten(int)      {}
+
+// each started transaction is counted once, however it is finished
+func TestAgentMetrics(t *testing.T) {
+	a := NewAgent()
+	m := new(countMetrics)
+	a.SetMetrics(m)
+	h := make(eventHandler, 6)
+	now := time.Now()
+	for i := byte(1); i <= 5; i++ {
+		if err := a.Start([TransactionIDSize]byte{i}, now.Add(time.Second), h, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res := &Message{TransactionID: [TransactionIDSize]byte{1}}
+	if err := res.Build(BindingSuccess); err != nil {
+		t.Fatal(err)
+	}
+	a.ProcessHandle(res, nil)
+	a.Stop([TransactionIDSize]byte{2})
+	a.StopBy(func(id [TransactionIDSize]byte, _ TransactionAgent) bool { return id[0] == 3 })
+	a.TimeOutHandle(now.Add(time.Second * 2)) // closes 4 and 5 by the deadline
+	if err := a.Start([TransactionIDSize]byte{6}, now.Add(time.Hour), h, nil); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	for i := 0; i < 6; i++ {
+		h.next(t)
+	}
+	if m.started != 6 || m.completed != 1 || m.timedOut != 2 || m.cancelled != 3 {
+		t.Fatalf("started %d, completed %d, timed out %d, cancelled %d", m.started, m.completed, m.timedOut, m.cancelled)
+	}
+}
+
+// StopBy cancels only the transactions of pred, and their late responses are dropped as duplicates
+func TestAgentStopBy(t *testing.T) {
+	a := NewAgent()
+	defer a.Close()
+	unmatched := make(eventHandler, 1)
+	a.SetUnmatchedResponseHandler(unmatched)
+	h := make(eventHandler, 4)
+	deadline := time.Now().Add(time.Hour)
+	for i := byte(1); i <= 4; i++ {
+		if err := a.Start([TransactionIDSize]byte{i}, deadline, h, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.StopBy(func(id [TransactionIDSize]byte, tr TransactionAgent) bool {
+		return tr.UserData.(byte)%2 == 0
+	})
+	for i := 0; i < 2; i++ {
+		e := h.next(t)
+		if e.Err != ErrTransactionStopped || e.UserData.(byte)%2 != 0 {
+			t.Fatalf("event is %+v", e)
+		}
+	}
+	h.none(t)
+	if a.Len() != 2 {
+		t.Fatalf("%d transactions, want 2", a.Len())
+	}
+
+	res := &Message{TransactionID: [TransactionIDSize]byte{2}}
+	if err := res.Build(BindingSuccess); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ProcessHandle(res, nil); err != nil {
+		t.Fatal(err)
+	}
+	unmatched.none(t)
+	h.none(t)
+}
+
+// Start fails over the limit of SetMaxTransactions, and the finished transactions free it
+func TestAgentMaxTransactions(t *testing.T) {
+	a := NewAgent()
+	defer a.Close()
+	a.SetMaxTransactions(2)
+	h := make(eventHandler, 4) // and the events of Close
+	deadline := time.Now().Add(time.Hour)
+	for i := byte(1); i <= 2; i++ {
+		if err := a.Start([TransactionIDSize]byte{i}, deadline, h, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Start([TransactionIDSize]byte{3}, deadline, h, nil); err != ErrTooManyTransactions {
+		t.Fatalf("err is %v, want %v", err, ErrTooManyTransactions)
+	}
+	a.Stop([TransactionIDSize]byte{1})
+	h.next(t)
+	if err := a.Start([TransactionIDSize]byte{3}, deadline, h, nil); err != nil {
+		t.Fatal(err)
+	}
+	a.SetMaxTransactions(0)
+	if err := a.Start([TransactionIDSize]byte{4}, deadline, h, nil); err != nil {
+		t.Fatalf("err of unlimited is %v", err)
+	}
+}
+
+// Pending lists the registered transactions, the oldest first
+func TestAgentPending(t *testing.T) {
+	clk := NewFakeClock(time.Unix(1000, 0))
+	a := NewAgent()
+	a.SetClock(clk)
+	h := make(eventHandler, 3)
+	defer a.Close()
+	deadline := clk.Now().Add(time.Hour)
+	for _, id := range []byte{2, 1, 3} {
+		if err := a.Start([TransactionIDSize]byte{id}, deadline, h, nil); err != nil {
+			t.Fatal(err)
+		}
+		clk.Advance(time.Second)
+	}
+	if err := a.SetRequestType([TransactionIDSize]byte{1}, BindingRequest); err != nil {
+		t.Fatal(err)
+	}
+
+	infos := a.Pending()
+	if len(infos) != 3 {
+		t.Fatalf("%d transactions, want 3", len(infos))
+	}
+	for i, id := range []byte{2, 1, 3} {
+		want := [TransactionIDSize]byte{id}
+		if infos[i].ID != hex.EncodeToString(want[:]) {
+			t.Fatalf("transaction %d is %s, want %x", i, infos[i].ID, want)
+		}
+		if age := time.Duration(3-i) * time.Second; infos[i].Age != age || !infos[i].Deadline.Equal(deadline) {
+			t.Fatalf("transaction %d is %+v, want age %s", i, infos[i], age)
+		}
+	}
+	if infos[1].Type != BindingRequest || infos[0].Type != (MessageType{}) {
+		t.Fatalf("types are %s and %s", infos[0].Type, infos[1].Type)
+	}
+}
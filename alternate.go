@@ -0,0 +1,146 @@
+package gostun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ALTERNATE-SERVER of 300 Try Alternate, same format as MAPPED-ADDRESS
+type AlternateServer Addr
+
+func (addr *AlternateServer) AddTo(m *Message) error {
+	return (*Addr)(addr).encodeAddr(m, ALTERNATE_SERVER)
+}
+
+func (addr *AlternateServer) GetFrom(m *Message) error {
+	return (*Addr)(addr).decodeAddr(m, ALTERNATE_SERVER)
+}
+
+func (addr AlternateServer) String() string {
+	return net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
+}
+
+const defaultMaxRedirects = 1
+
+// 300 Try Alternate which is not followed, Server is the alternate address.
+// Err is the parse error of ALTERNATE-SERVER, then Server is zero
+type AlternateError struct {
+	*StunError
+	Server AlternateServer
+	Err    error
+}
+
+func (e *AlternateError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: invalid ALTERNATE-SERVER: %s", e.StunError.Error(), e.Err)
+	}
+	return fmt.Sprintf("%s: alternate server %s", e.StunError.Error(), e.Server)
+}
+
+// errors.As finds *StunError of e
+func (e *AlternateError) Unwrap() error {
+	return e.StunError
+}
+
+/*
+   RFC 5389 section 11: ALTERNATE-SERVER
+   If the client receives a 300 error response with ALTERNATE-SERVER,
+   the client SHOULD resend the request to the indicated address.
+   the alternate server MUST be the same address family as the request.
+*/
+
+// send m by Do, and resend it to ALTERNATE-SERVER of 300 up to redirects times
+func (c *Client) doRedirect(m *Message, deadline time.Time, redirects int) (*Message, error) {
+	res, err := c.do(m, deadline)
+	if !IsTryAlternate(err) {
+		return res, err
+	}
+	var alt AlternateServer
+	if altErr := alt.GetFrom(res); altErr != nil {
+		return res, &AlternateError{
+			StunError: err.(*StunError),
+			Err:       altErr,
+		}
+	}
+	if redirects <= 0 {
+		return res, &AlternateError{
+			StunError: err.(*StunError),
+			Server:    alt,
+		}
+	}
+	ReleaseMessage(res)
+
+	ac, err := c.dialAlternate(alt)
+	if err != nil {
+		return nil, err
+	}
+	defer ac.Close()
+
+	// a new transaction of the alternate server, RFC 5389 section 7.2.
+	// the id of m which has MESSAGE-INTEGRITY or FINGERPRINT is kept, since they cover it
+	if !m.hasIntegrity() && !m.hasFingerprint() {
+		if err := m.NewTransactionID(); err != nil {
+			return nil, err
+		}
+	}
+	return ac.doRedirect(m, deadline, redirects-1)
+}
+
+// dial the alternate server with the network, options and handlers of c, Reliable is of the new conn
+func (c *Client) dialAlternate(alt AlternateServer) (*Client, error) {
+	raddr := remoteAddr(c.conn)
+	if raddr == nil {
+		return nil, errors.New("alternate server needs the remote address of the connection")
+	}
+	if (remoteIP(c.conn).To4() == nil) != (alt.IP.To4() == nil) {
+		err := fmt.Sprintf("alternate server %s is not the same address family", alt)
+		return nil, errors.New(err)
+	}
+	conn, err := net.Dial(raddr.Network(), alt.String())
+	if err != nil {
+		return nil, err
+	}
+	ac := newClient(conn)
+	ac.clientConfig = c.clientConfig
+	ac.Reliable = isReliable(conn)
+	c.rw.RLock()
+	l, metrics := c.logger, c.metrics
+	if c.timeoutRate > 0 {
+		ac.TimeoutRate = c.timeoutRate
+	}
+	c.rw.RUnlock()
+	ac.SetLogger(l)
+	ac.SetMetrics(metrics)
+	ac.setClock(c.clock)
+	ac.copySettings(c)
+	ac.run()
+	return ac, nil
+}
+
+type settingsHandle interface {
+	settings() agentSettings
+	setSettings(agentSettings)
+}
+
+// copy the handlers and limits of the agent of from, the responders answer on c
+func (c *Client) copySettings(from *Client) {
+	src, ok := from.agent.(settingsHandle)
+	if !ok {
+		return
+	}
+	dst, ok := c.agent.(settingsHandle)
+	if !ok {
+		return
+	}
+	s := src.settings()
+	if r, ok := s.requestHandler.(responder); ok {
+		s.requestHandler = responder{c: c, h: r.h}
+	}
+	if r, ok := s.unmatchedResponseHandler.(responder); ok {
+		s.unmatchedResponseHandler = responder{c: c, h: r.h}
+	}
+	dst.setSettings(s)
+}
@@ -0,0 +1,161 @@
+package gostun
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// the client of the alternate server has all options, handlers and limits of the original one
+func TestDialAlternateOptions(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClient(conn) // the loops are not started, so the options can be changed
+	defer c.Close()
+
+	v := reflect.ValueOf(&c.clientConfig).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if v.Type().Field(i).PkgPath != "" {
+			continue // unexported
+		}
+		switch f.Kind() {
+		case reflect.Bool:
+			f.SetBool(!f.Bool())
+		case reflect.Int, reflect.Int64:
+			f.SetInt(f.Int() + 3)
+		case reflect.String:
+			f.SetString("test")
+		}
+	}
+
+	h := make(eventHandler, 1)
+	c.SetRequestHandler(h)
+	c.SetMaxTransactions(7)
+	c.SetDuplicateWindow(time.Second * 7)
+	c.timeoutRate = time.Millisecond * 7 // of SetTimeoutRate
+
+	addr := pc.LocalAddr().(*net.UDPAddr)
+	ac, err := c.dialAlternate(AlternateServer{IP: addr.IP, Port: addr.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	if ac.TimeoutRate != c.timeoutRate {
+		t.Errorf("TimeoutRate is %s, want %s", ac.TimeoutRate, c.timeoutRate)
+	}
+	s := ac.agent.(*Agent).settings()
+	if s.max != 7 || s.window != time.Second*7 {
+		t.Errorf("max is %d and window is %s", s.max, s.window)
+	}
+	if r, ok := s.requestHandler.(responder); !ok || r.c != ac {
+		t.Errorf("request handler is %#v, want the responder of the alternate client", s.requestHandler)
+	}
+	av := reflect.ValueOf(&ac.clientConfig).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if v.Type().Field(i).PkgPath != "" || name == "Reliable" || name == "TimeoutRate" {
+			continue // Reliable is of the conn, TimeoutRate is of SetTimeoutRate
+		}
+		if !reflect.DeepEqual(v.Field(i).Interface(), av.Field(i).Interface()) {
+			t.Errorf("%s is %v, want %v", name, av.Field(i).Interface(), v.Field(i).Interface())
+		}
+	}
+}
+
+// 300 without valid ALTERNATE-SERVER is returned as *AlternateError with the parse error
+func TestDoAlternateInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		alt  []Setter
+		err  bool
+	}{
+		{"missing", nil, true},
+		{"not followed", []Setter{&AlternateServer{IP: net.IPv4(192, 0, 2, 1), Port: 3478}}, false},
+	} {
+		c, peer := testClient(t)
+		c.MaxRedirects = 0
+		done := make(chan error, 1)
+		go func() {
+			res, err := c.Do(MessageBuild(TransactionID, BindingRequest), time.Now().Add(time.Second*5))
+			if res != nil {
+				ReleaseMessage(res)
+			}
+			done <- err
+		}()
+		code := &ErrorCodeAttribute{Code: CodeTryAlternate, Reason: ErrorReason[CodeTryAlternate]}
+		peer.Write(response(t, readRequest(t, peer), BindingError, append([]Setter{code}, tc.alt...)...))
+
+		err := <-done
+		var e *AlternateError
+		if !errors.As(err, &e) || !IsTryAlternate(err) {
+			t.Fatalf("%s: err is %v, want *AlternateError", tc.name, err)
+		}
+		if (e.Err != nil) != tc.err {
+			t.Fatalf("%s: parse error is %v", tc.name, e.Err)
+		}
+		if !tc.err && !e.Server.IP.Equal(net.IPv4(192, 0, 2, 1)) {
+			t.Fatalf("%s: server is %s", tc.name, e.Server)
+		}
+	}
+}
+
+// the request redirected by 300 is a new transaction of the alternate server
+func TestDoAlternateNewTransaction(t *testing.T) {
+	primary, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	alternate, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alternate.Close()
+	alt := alternate.LocalAddr().(*net.UDPAddr)
+	ids := make(chan [TransactionIDSize]byte, 2)
+	serve := func(pc net.PacketConn, s ...Setter) {
+		b := make([]byte, defaultMaxMessageSize)
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		req := &Message{Raw: b[:n]}
+		if err := req.Decode(); err != nil {
+			return
+		}
+		ids <- req.TransactionID
+		res := &Message{TransactionID: req.TransactionID}
+		if err := res.Build(s...); err != nil {
+			return
+		}
+		pc.WriteTo(res.Raw, addr)
+	}
+	go serve(primary, BindingError,
+		&ErrorCodeAttribute{Code: CodeTryAlternate, Reason: ErrorReason[CodeTryAlternate]},
+		&AlternateServer{IP: alt.IP, Port: alt.Port})
+	go serve(alternate, BindingSuccess, &XORMappedAddress{IP: net.IPv4(192, 0, 2, 1), Port: 1000})
+
+	c, err := Dial("udp", primary.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	res, err := c.Do(MessageBuild(TransactionID, BindingRequest), time.Now().Add(time.Second*5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ReleaseMessage(res)
+	if first, second := <-ids, <-ids; first == second {
+		t.Fatalf("transaction id %x is reused for the alternate server", first)
+	}
+}
@@ -1,6 +1,9 @@
 package gostun
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 /*
     0                   1                   2                   3
@@ -24,6 +27,8 @@ type AttributeField struct {
 
 type Attributes []AttributeField
 
+var ErrAttributeNotFound = errors.New("Attribute is not matched")
+
 // Comprehension-required range (0x0000-0x7FFF): page 43
 const (
 	MAPPED_ADDRESS     AttributeType = 0x0001
@@ -40,6 +45,57 @@ const (
 	FINGERPRINT      AttributeType = 0x8028
 )
 
+// classic STUN attributes: RFC 3489 page 27
+const (
+	RESPONSE_ADDRESS AttributeType = 0x0002
+	SOURCE_ADDRESS   AttributeType = 0x0004
+	CHANGED_ADDRESS  AttributeType = 0x0005
+)
+
+// XOR-MAPPED-ADDRESS of the drafts of RFC 5389, which some old servers still return
+const (
+	XOR_MAPPED_ADDRESS_LEGACY AttributeType = 0x8020
+)
+
+// STUN attributes of RFC 8489 section 18.3
+const (
+	MESSAGE_INTEGRITY_SHA256 AttributeType = 0x001C
+	PASSWORD_ALGORITHM       AttributeType = 0x001D
+	USERHASH                 AttributeType = 0x001E
+
+	PASSWORD_ALGORITHMS AttributeType = 0x8002
+)
+
+// TURN attributes: RFC 5766 page 42
+const (
+	CHANNEL_NUMBER      AttributeType = 0x000C
+	LIFETIME            AttributeType = 0x000D
+	XOR_PEER_ADDRESS    AttributeType = 0x0012
+	DATA                AttributeType = 0x0013
+	XOR_RELAYED_ADDRESS AttributeType = 0x0016
+	REQUESTED_TRANSPORT AttributeType = 0x0019
+)
+
+// NAT behavior discovery attributes: RFC 5780 page 27
+const (
+	CHANGE_REQUEST  AttributeType = 0x0003
+	PADDING         AttributeType = 0x0026
+	RESPONSE_PORT   AttributeType = 0x0027
+	RESPONSE_ORIGIN AttributeType = 0x802B
+	OTHER_ADDRESS   AttributeType = 0x802C
+	CACHE_TIMEOUT   AttributeType = 0x802D
+)
+
+// ICE attributes: RFC 5245 page 87
+const (
+	PRIORITY      AttributeType = 0x0024
+	USE_CANDIDATE AttributeType = 0x0025
+
+	ICE_CONTROLLED  AttributeType = 0x8029
+	ICE_CONTROLLING AttributeType = 0x802A
+)
+
+// names of the registered attributes, a new attribute adds its name here with its type
 var AttrTypeName = map[AttributeType]string{
 	MAPPED_ADDRESS:     "MAPPED-ADDRESS",
 	USERNAME:           "USERNAME",
@@ -51,32 +107,103 @@ var AttrTypeName = map[AttributeType]string{
 	XOR_MAPPED_ADDRESS: "XOR-MAPPED-ADDRESS",
 
 	SOFTWARE:         "SOFTWARE",
-	ALTERNATE_SERVER: "ALTERNATE_SERVER",
+	ALTERNATE_SERVER: "ALTERNATE-SERVER",
 	FINGERPRINT:      "FINGERPRINT",
+
+	XOR_MAPPED_ADDRESS_LEGACY: "XOR-MAPPED-ADDRESS(legacy)",
+
+	RESPONSE_ADDRESS: "RESPONSE-ADDRESS",
+	SOURCE_ADDRESS:   "SOURCE-ADDRESS",
+	CHANGED_ADDRESS:  "CHANGED-ADDRESS",
+
+	MESSAGE_INTEGRITY_SHA256: "MESSAGE-INTEGRITY-SHA256",
+	PASSWORD_ALGORITHM:       "PASSWORD-ALGORITHM",
+	USERHASH:                 "USERHASH",
+
+	PASSWORD_ALGORITHMS: "PASSWORD-ALGORITHMS",
+
+	CHANNEL_NUMBER:      "CHANNEL-NUMBER",
+	LIFETIME:            "LIFETIME",
+	XOR_PEER_ADDRESS:    "XOR-PEER-ADDRESS",
+	DATA:                "DATA",
+	XOR_RELAYED_ADDRESS: "XOR-RELAYED-ADDRESS",
+	REQUESTED_TRANSPORT: "REQUESTED-TRANSPORT",
+
+	CHANGE_REQUEST:  "CHANGE-REQUEST",
+	PADDING:         "PADDING",
+	RESPONSE_PORT:   "RESPONSE-PORT",
+	RESPONSE_ORIGIN: "RESPONSE-ORIGIN",
+	OTHER_ADDRESS:   "OTHER-ADDRESS",
+	CACHE_TIMEOUT:   "CACHE-TIMEOUT",
+
+	PRIORITY:      "PRIORITY",
+	USE_CANDIDATE: "USE-CANDIDATE",
+
+	ICE_CONTROLLED:  "ICE-CONTROLLED",
+	ICE_CONTROLLING: "ICE-CONTROLLING",
 }
 
-func (at AttributeType) String() string {
-	name, ok := AttrTypeName[at]
-	if !ok {
-		return fmt.Sprintf("non-attribute: %x", at)
+// name of the attribute type t, "0x%04x" if t is not registered
+func AttributeName(t uint16) string {
+	if name, ok := AttrTypeName[AttributeType(t)]; ok {
+		return name
 	}
-	return name
+	return fmt.Sprintf("0x%04x", t)
+}
+
+func (at AttributeType) String() string {
+	return AttributeName(uint16(at))
 }
 
 func (af AttributeField) String() string {
 	return fmt.Sprintf("%s: 0x%x", af.Type, af.Value)
 }
 
+// returns the first attribute of t
+func (attr Attributes) Get(t AttributeType) (AttributeField, bool) {
+	for _, a := range attr {
+		if a.Type == t {
+			return a, true
+		}
+	}
+	return AttributeField{}, false
+}
+
+// returns all attributes of t in wire order, e.g. repeated XOR-PEER-ADDRESS
+func (attr Attributes) GetAll(t AttributeType) []AttributeField {
+	var all []AttributeField
+	for _, a := range attr {
+		if a.Type == t {
+			all = append(all, a)
+		}
+	}
+	return all
+}
+
+// returns all attributes of t in m
+func (m *Message) GetAll(t AttributeType) []AttributeField {
+	return m.Attributes.GetAll(t)
+}
+
+// returns the first attribute of t in m
+func (m *Message) Get(t AttributeType) (AttributeField, bool) {
+	return m.Attributes.Get(t)
+}
+
 // Since STUN aligns attributes on 32-bit boundaries, attributes whose content
 // is not a multiple of 4 bytes are padded with 1, 2, or 3 bytes of
 // padding so that its value contains a multiple of 4 bytes.  The
 // padding bits are ignored, and may be any value.
 func (a *AttributeField) PaddingValue() int {
+	return paddingLength(int(a.Length))
+}
+
+// round up l to a multiple of 4
+func paddingLength(l int) int {
 	const padding = 4
-	al := int(a.Length)
-	l := padding * (al / padding)
-	if l < al {
-		l += padding
+	n := padding * (l / padding)
+	if n < l {
+		n += padding
 	}
-	return l
+	return n
 }
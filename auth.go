@@ -0,0 +1,173 @@
+package gostun
+
+import (
+	"bytes"
+	"time"
+)
+
+/*
+   Long-term credential mechanism:
+   the first request is sent without credentials, and the server rejects it
+   with 401 (Unauthorized) including REALM and NONCE.  The client retries
+   with USERNAME, REALM, NONCE and MESSAGE-INTEGRITY.  If the nonce is no
+   longer valid, the server rejects it with 438 (Stale Nonce) including
+   a new NONCE, and the client retries with it.
+
+   RFC 8489 servers start NONCE with the cookie "obMatJos2", and the client
+   uses MESSAGE-INTEGRITY-SHA256 for them instead of MESSAGE-INTEGRITY.
+   If 401 has PASSWORD-ALGORITHMS, the client selects one of them by
+   PASSWORD-ALGORITHM, echoes PASSWORD-ALGORITHMS, and derives the key by it.
+*/
+
+const nonceCookie = "obMatJos2"
+
+// the server of nonce supports RFC 8489, so MESSAGE-INTEGRITY-SHA256 is preferred
+func isRFC8489Nonce(nonce Nonce) bool {
+	return bytes.HasPrefix(nonce, []byte(nonceCookie))
+}
+
+// long-term credential of the challenge of 401, the requests of the allocation reuse it
+type longTermCredential struct {
+	username  Username
+	realm     Realm
+	nonce     Nonce // updated by 438
+	integrity Setter
+	algs      []Setter // PASSWORD-ALGORITHM and PASSWORD-ALGORITHMS of the challenge
+}
+
+// send m with the long-term credential, answering 401 and one 438 of the server.
+// the answered responses are released, the last response is returned as Do
+func (c *Client) DoAuthenticated(m *Message, username, password string, deadline time.Time) (*Message, error) {
+	res, _, err := c.doAuthenticated(m, username, password, deadline)
+	return res, err
+}
+
+// DoAuthenticated which returns the credential of the challenge, nil if the server did not ask it
+func (c *Client) doAuthenticated(m *Message, username, password string, deadline time.Time) (*Message, *longTermCredential, error) {
+	res, err := c.Do(m, deadline)
+	if !IsUnauthorized(err) {
+		return res, nil, err
+	}
+
+	var (
+		realm Realm
+		nonce Nonce
+	)
+	if realm.GetFrom(res) != nil || nonce.GetFrom(res) != nil {
+		return res, nil, err // 401 without challenge
+	}
+	integrity, algs, ok := longTermIntegrity(res, username, string(realm), password, nonce)
+	if !ok {
+		return res, nil, err // no supported password algorithm
+	}
+	ReleaseMessage(res) // the challenge is copied
+
+	cred := &longTermCredential{
+		username:  Username(username),
+		realm:     realm,
+		nonce:     nonce,
+		integrity: integrity,
+		algs:      algs,
+	}
+	res, err = c.doCredential(m, cred, deadline)
+	return res, cred, err
+}
+
+// send m with cred, and retry once with the fresh nonce of 438, which is set to cred
+func (c *Client) doCredential(m *Message, cred *longTermCredential, deadline time.Time) (*Message, error) {
+	stale := false
+	for {
+		req, err := c.authRequest(m, cred.username, cred.realm, cred.nonce, cred.integrity, cred.algs...)
+		if err != nil {
+			return nil, err
+		}
+		res, err := c.Do(req, deadline)
+		if stale || !IsStaleNonce(err) {
+			return res, err
+		}
+		// retry once with the fresh nonce
+		stale = true
+		var nonce Nonce
+		if nonce.GetFrom(res) != nil {
+			return res, err
+		}
+		ReleaseMessage(res)
+		cred.nonce = nonce
+	}
+}
+
+// integrity of the challenge res, and PASSWORD-ALGORITHM and PASSWORD-ALGORITHMS if res has them.
+// ok is false if no algorithm of res is supported
+func longTermIntegrity(res *Message, username, realm, password string, nonce Nonce) (integrity Setter, algs []Setter, ok bool) {
+	alg := PasswordAlgorithmMD5
+	var offered PasswordAlgorithms
+	if offered.GetFrom(res) == nil {
+		if alg, ok = offered.selected(); !ok {
+			return nil, nil, false
+		}
+		algs = []Setter{alg, offered}
+	}
+	key, err := NewLongTermIntegrityAlgorithm(alg, username, realm, password)
+	if err != nil {
+		return nil, nil, false
+	}
+	if algs != nil || isRFC8489Nonce(nonce) {
+		return MessageIntegritySHA256{Key: key}, algs, true
+	}
+	return key, nil, true
+}
+
+// copy m with new transaction id and the credential attributes, extra is added before integrity
+func (c *Client) authRequest(m *Message, username Username, realm Realm, nonce Nonce, integrity Setter, extra ...Setter) (*Message, error) {
+	req := &Message{
+		Type: m.Type,
+	}
+	if err := req.NewTransactionID(); err != nil {
+		return nil, err
+	}
+	req.Encode()
+
+	fingerprint := false
+	for _, a := range m.Attributes {
+		switch a.Type {
+		case USERNAME, REALM, NONCE, MESSAGE_INTEGRITY, MESSAGE_INTEGRITY_SHA256,
+			PASSWORD_ALGORITHM, PASSWORD_ALGORITHMS:
+			continue
+		case FINGERPRINT:
+			fingerprint = true
+			continue
+		}
+		if err := req.Add(a.Type, a.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	// SOFTWARE is not added by Do after MESSAGE-INTEGRITY
+	if err := c.addSoftware(req); err != nil {
+		return nil, err
+	}
+	if err := username.AddTo(req); err != nil {
+		return nil, err
+	}
+	if err := realm.AddTo(req); err != nil {
+		return nil, err
+	}
+	if err := nonce.AddTo(req); err != nil {
+		return nil, err
+	}
+	for _, s := range extra {
+		if err := s.AddTo(req); err != nil {
+			return nil, err
+		}
+	}
+	if err := integrity.AddTo(req); err != nil {
+		return nil, err
+	}
+	if fingerprint {
+		if err := FingerprintAttr.AddTo(req); err != nil {
+			return nil, err
+		}
+	}
+
+	return req, nil
+}
@@ -0,0 +1,45 @@
+package gostun
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// 401 and 438 are answered, and their responses are released
+func TestDoAuthenticatedStaleNonce(t *testing.T) {
+	c, peer := testClient(t)
+	type result struct {
+		res *Message
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := c.DoAuthenticated(MessageBuild(TransactionID, BindingRequest), "user", "pass", time.Now().Add(time.Second*5))
+		done <- result{res, err}
+	}()
+
+	errorCode := func(code int) Setter {
+		return &ErrorCodeAttribute{Code: code, Reason: ErrorReason[code]}
+	}
+	req := readRequest(t, peer)
+	peer.Write(response(t, req, BindingError, errorCode(CodeUnauthorized), Realm("realm"), Nonce("first")))
+	req = readRequest(t, peer)
+	if _, ok := req.Get(MESSAGE_INTEGRITY); !ok {
+		t.Fatal("no MESSAGE-INTEGRITY of the answer to 401")
+	}
+	peer.Write(response(t, req, BindingError, errorCode(CodeStaleNonce), Realm("realm"), Nonce("second")))
+	req = readRequest(t, peer)
+	if n, _ := req.Get(NONCE); !bytes.Equal(n.Value, []byte("second")) {
+		t.Fatalf("NONCE is %q, want the fresh one", n.Value)
+	}
+	peer.Write(response(t, req, BindingSuccess))
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.res.Type != BindingSuccess || r.res.TransactionID != req.TransactionID {
+		t.Fatalf("response is %s", r.res)
+	}
+}
@@ -0,0 +1,50 @@
+package gostun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+   Big-endian access of the attribute values with the bounds check.
+   the values are sent by the peer, so a truncated value is an error
+   instead of the panic of slicing out of range.
+*/
+
+func shortBuffer(b []byte, off, size int) error {
+	if off >= 0 && off+size <= len(b) {
+		return nil
+	}
+	err := fmt.Sprintf("buffer length(%d) is less than %d at offset %d", len(b), size, off)
+	return errors.New(err)
+}
+
+func getU16(b []byte, off int) (uint16, error) {
+	if err := shortBuffer(b, off, 2); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b[off:]), nil
+}
+
+func getU32(b []byte, off int) (uint32, error) {
+	if err := shortBuffer(b, off, 4); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[off:]), nil
+}
+
+func getU64(b []byte, off int) (uint64, error) {
+	if err := shortBuffer(b, off, 8); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[off:]), nil
+}
+
+func putU16(b []byte, off int, v uint16) error {
+	if err := shortBuffer(b, off, 2); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(b[off:], v)
+	return nil
+}
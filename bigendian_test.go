@@ -0,0 +1,54 @@
+package gostun
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+// the getters of random truncated buffers return an error instead of the panic
+func TestGetTruncated(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		b := make([]byte, r.Intn(12))
+		r.Read(b)
+		off := r.Intn(16) - 2 // negative and past the end too
+
+		v16, err16 := getU16(b, off)
+		v32, err32 := getU32(b, off)
+		v64, err64 := getU64(b, off)
+		for _, tc := range []struct {
+			size int
+			got  uint64
+			err  error
+			want func([]byte) uint64
+		}{
+			{2, uint64(v16), err16, func(b []byte) uint64 { return uint64(binary.BigEndian.Uint16(b)) }},
+			{4, uint64(v32), err32, func(b []byte) uint64 { return uint64(binary.BigEndian.Uint32(b)) }},
+			{8, v64, err64, binary.BigEndian.Uint64},
+		} {
+			fits := off >= 0 && off+tc.size <= len(b)
+			if !fits {
+				if tc.err == nil {
+					t.Fatalf("no error of %d bytes at %d of %x", tc.size, off, b)
+				}
+				continue
+			}
+			if tc.err != nil {
+				t.Fatalf("%d bytes at %d of %x: %v", tc.size, off, b, tc.err)
+			}
+			if want := tc.want(b[off:]); tc.got != want {
+				t.Fatalf("%d bytes at %d of %x is %x, want %x", tc.size, off, b, tc.got, want)
+			}
+		}
+	}
+}
+
+func TestPutTruncated(t *testing.T) {
+	for n := 0; n < 6; n++ {
+		b := make([]byte, n)
+		if err := putU16(b, n-1, 1); err == nil {
+			t.Fatalf("no error of putU16 at %d of %d bytes", n-1, n)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package gostun
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
 )
 
@@ -58,28 +60,25 @@ func (m *Message) AllocRaw() {
 
 // write message type to m.Raw
 func (m *Message) WriteMessageType() {
-	// Class
-	class := uint16(m.Type.Class)
-	c0 := (class & bitc0) << shiftc0 // 4 bit shift
-	c1 := (class & bitc1) << shiftc1 // 7 bit shift
-	c := c0 + c1
-
-	// Method
-	method := uint16(m.Type.Method)
-	m1m3 := method & mbit1
-	m4m6 := method & mbit2
-	m7m11 := method & mbit3
-	method = m1m3 + (m4m6 << methodshift1) + (m7m11 << methodshift2)
-
-	mtype := c + method
-
-	binary.BigEndian.PutUint16(m.Raw[0:2], mtype)
+	binary.BigEndian.PutUint16(m.Raw[0:2], m.Type.Value())
 }
 
 func (m *Message) WriteMessageLength() {
 	binary.BigEndian.PutUint16(m.Raw[2:4], uint16(m.Length))
 }
 
+// set m.Length to the length of the attributes in m.Raw and write it
+func (m *Message) setLength() {
+	m.Length = uint32(len(m.Raw) - messageHeader)
+	m.WriteMessageLength()
+}
+
+// write the length field including extra bytes, e.g. the attribute which is not added yet
+// for MESSAGE-INTEGRITY and FINGERPRINT. m.Length is not changed, so WriteMessageLength restores it
+func (m *Message) WriteLengthIncluding(extra int) {
+	binary.BigEndian.PutUint16(m.Raw[2:4], uint16(int(m.Length)+extra))
+}
+
 func (m *Message) WriteMagicCookie() {
 	binary.BigEndian.PutUint32(m.Raw[4:8], magicCookie)
 }
@@ -88,7 +87,89 @@ func (m *Message) WriteTransactionID() {
 	copy(m.Raw[8:messageHeader], m.TransactionID[:]) // build and decode message
 }
 
-func (m *Message) build(s ...Transaer) error {
+// serialize m.Type, m.TransactionID and m.Attributes to m.Raw.
+// Length of the attributes is the unpadded length of Value, and the values are
+// padded to 4 bytes in m.Raw
+func (m *Message) Encode() {
+	l := 0
+	for _, a := range m.Attributes {
+		l += attributeHeader + paddingLength(len(a.Value))
+	}
+
+	m.Raw = make([]byte, messageHeader, messageHeader+l)
+	m.Length = uint32(l)
+	m.WriteMessageType()
+	m.WriteMessageLength()
+	m.WriteMagicCookie()
+	m.WriteTransactionID()
+
+	for i, a := range m.Attributes {
+		var h [attributeHeader]byte
+		binary.BigEndian.PutUint16(h[0:2], uint16(a.Type))
+		binary.BigEndian.PutUint16(h[2:4], uint16(len(a.Value)))
+		m.Raw = append(m.Raw, h[:]...)
+		first := len(m.Raw)
+		m.Raw = append(m.Raw, a.Value...)
+		for j := len(a.Value); j < paddingLength(len(a.Value)); j++ {
+			m.Raw = append(m.Raw, 0)
+		}
+		// Length is written, and Value refers to m.Raw same as the decoded message
+		m.Attributes[i].Length = uint16(len(a.Value))
+		m.Attributes[i].Value = m.Raw[first : first+len(a.Value)]
+	}
+}
+
+// append the attribute to m.Raw with padding, and to m.Attributes
+func (m *Message) Add(t AttributeType, v []byte) error {
+	if m.hasFingerprint() {
+		return ErrAttributeAfterFingerprint
+	}
+	if _, ok := m.Get(MESSAGE_INTEGRITY_SHA256); ok && t != FINGERPRINT {
+		return ErrAttributeAfterIntegrity
+	}
+	if _, ok := m.Get(MESSAGE_INTEGRITY); ok && t != FINGERPRINT && t != MESSAGE_INTEGRITY_SHA256 {
+		return ErrAttributeAfterIntegrity
+	}
+	if len(m.Raw) < messageHeader {
+		m.Encode() // write header and m.Attributes
+	}
+	if l := int(m.Length) + attributeHeader + paddingLength(len(v)); l > maxMessageLength {
+		err := fmt.Sprintf("adding %s makes message length(%d) more than %d", t, l, maxMessageLength)
+		return errors.New(err)
+	}
+
+	first := len(m.Raw)
+	last := first + attributeHeader + paddingLength(len(v))
+	for cap(m.Raw) < last {
+		m.Raw = append(m.Raw[:cap(m.Raw)], 0)
+	}
+	m.Raw = m.Raw[:last]
+
+	buf := m.Raw[first:last]
+	binary.BigEndian.PutUint16(buf[0:2], uint16(t))
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(v)))
+	copy(buf[attributeHeader:], v)
+	for i := attributeHeader + len(v); i < len(buf); i++ {
+		buf[i] = 0 // padding
+	}
+
+	m.Attributes = append(m.Attributes, AttributeField{
+		Type:   t,
+		Length: uint16(len(v)),
+		Value:  buf[attributeHeader : attributeHeader+len(v)],
+	})
+	m.setLength()
+
+	return nil
+}
+
+// write the header of m and apply s in order, e.g. the type, the transaction id and the attributes.
+// the previous contents of m are dropped, so m can be reused
+func (m *Message) Build(s ...Setter) error {
+	m.Raw = m.Raw[:0] // AllocRaw appends the header
+	m.Attributes = m.Attributes[:0]
+	m.Length = 0
+
 	// make message header
 	m.AllocRaw() // alloc 0, part of message header size
 	m.WriteMessageType()
@@ -97,7 +178,7 @@ func (m *Message) build(s ...Transaer) error {
 	m.WriteTransactionID()
 
 	for _, v := range s {
-		if err := v.SetTo(m); err != nil {
+		if err := v.AddTo(m); err != nil {
 			return err
 		}
 	}
@@ -105,13 +186,13 @@ func (m *Message) build(s ...Transaer) error {
 	return nil
 }
 
-// wraps m.build
-func Build(s ...Transaer) (*Message, error) {
+// wraps m.Build
+func Build(s ...Setter) (*Message, error) {
 	m := new(Message)
-	return m, m.build(s...)
+	return m, m.Build(s...)
 }
 
-func MessageBuild(s ...Transaer) *Message {
+func MessageBuild(s ...Setter) *Message {
 	m, err := Build(s...)
 	if err != nil {
 		log.Fatal(err)
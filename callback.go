@@ -1,9 +1,11 @@
 package gostun
 
 import (
+	"context"
 	"errors"
-	"io"
+	"fmt"
 	"log"
+	"net"
 	"sync"
 	"time"
 )
@@ -47,54 +49,203 @@ func (c *CallbackHandle) Wait() {
 	c.Cond.L.Unlock()
 }
 
-func (a *Agent) TransactionHandle(id [TransactionIDSize]byte, h Handler, rto time.Time) error {
-	a.mux.Lock()
-	defer a.mux.Unlock()
+// contextHandle notifies done after h is called
+type contextHandle struct {
+	h    Handler
+	done chan struct{}
+}
 
-	if a.closed {
-		return errors.New("agent closed")
-	}
+func (c *contextHandle) HandleEvent(e MessageObj) {
+	c.h.HandleEvent(e)
+	close(c.done)
+}
+
+var ErrWriteTimeout = errors.New("write of the request is timed out")
+
+// send m and register the transaction with h, the write is bounded by rto if conn supports it.
+// if sending is failed, h is called with the error and it is returned
+func (c *Client) TransactionLaunch(m *Message, h Handler, rto time.Time) error {
+	return c.TransactionLaunchData(m, h, rto, nil)
+}
 
-	_, exist := a.transactions[id]
-	if exist {
-		return errors.New("transaction exists with same id")
+// TransactionLaunch with userData, which is passed to h as MessageObj.UserData.
+// e.g. the candidate pair of ICE, so h which is shared by the transactions does not look it up
+func (c *Client) TransactionLaunchData(m *Message, h Handler, rto time.Time, userData interface{}) error {
+	if err := c.addConfigured(m); err != nil {
+		return err
+	}
+	if h != nil {
+		if err := c.start(m, rto, h, userData); err != nil {
+			return err
+		}
+		if c.MaxRetries > 0 && !c.Reliable {
+			rto := c.startRTO()
+			if err := c.agent.ScheduleHandle(m.TransactionID, m.Raw, rto, c.MaxRetries); err != nil {
+				c.agent.CancelHandle(m.TransactionID, err)
+				return err
+			}
+			c.logEvent(LogEvent{Kind: LogRetransmitScheduled, ID: m.TransactionID, RTO: rto})
+		}
 	}
 
-	a.transactions[id] = TransactionAgent{
-		ID:      id,
-		handler: h,
-		Timeout: rto,
+	if _, err := c.writeMessage(m, rto); err != nil {
+		if h != nil {
+			c.agent.CancelHandle(m.TransactionID, err) // no response is waited
+		}
+		return err
 	}
+	c.logEvent(LogEvent{Kind: LogRequestSent, ID: m.TransactionID, Type: m.Type})
 
 	return nil
 }
 
-func (c *Client) TransactionLaunch(m *Message, h Handler, rto time.Time) error {
-	if h != nil {
-		if err := c.agent.TransactionHandle(m.TransactionID, h, rto); err != nil {
+const maxTransactionIDRetries = 3
+
+// register the transaction of m, new transaction id is set to m if the id is used.
+// the id of m which has MESSAGE-INTEGRITY or FINGERPRINT is not changed, since they cover the id
+func (c *Client) start(m *Message, deadline time.Time, h Handler, userData interface{}) error {
+	for i := 0; ; i++ {
+		err := c.agent.Start(m.TransactionID, deadline, h, userData)
+		if err == nil {
+			return c.setRequestType(m)
+		}
+		if err != ErrTransactionExists || i == maxTransactionIDRetries {
+			return err
+		}
+		if m.hasIntegrity() || m.hasFingerprint() {
 			return err
 		}
+		if err := m.NewTransactionID(); err != nil {
+			return err
+		}
+	}
+}
+
+// the response of m is checked by the agent, if it supports it
+func (c *Client) setRequestType(m *Message) error {
+	a, ok := c.agent.(interface {
+		SetRequestType([TransactionIDSize]byte, MessageType) error
+	})
+	if !ok {
+		return nil
 	}
+	return a.SetRequestType(m.TransactionID, m.Type) // fails only if the transaction is already finished
+}
 
-	err := m.WriteTo(c.conn)
-	if err != nil {
-		return err
+// write b to conn before deadline, zero deadline means no deadline.
+// the deadline is set only while b is written, so the writes are serialized
+func (c *Client) write(b []byte, deadline time.Time) error {
+	return c.writeTo(b, nil, deadline)
+}
+
+// write b to addr on the unconnected socket, nil addr or the other conn writes to the server
+func (c *Client) writeTo(b []byte, addr net.Addr, deadline time.Time) error {
+	d, ok := c.conn.(interface {
+		SetWriteDeadline(time.Time) error
+	})
+	p, unconnected := c.conn.(packetConnection)
+
+	set := ok && !deadline.IsZero()
+	c.wmux.Lock()
+	if set {
+		d.SetWriteDeadline(deadline)
+	}
+	var (
+		n   int
+		err error
+	)
+	if unconnected && addr != nil {
+		n, err = p.WriteTo(b, addr)
+	} else {
+		n, err = c.conn.Write(b)
+	}
+	if set {
+		d.SetWriteDeadline(time.Time{})
+	}
+	c.wmux.Unlock()
+
+	c.getMetrics().BytesWritten(n)
+	if isTimeout(err) {
+		return ErrWriteTimeout
 	}
+	return err
+}
+
+/*
+   Indications are not retransmitted and have no response,
+   so the transaction is not registered to the agent.
+*/
 
+// send the indication m, e.g. keepalive Binding indication and TURN Send indication
+func (c *Client) Indicate(m *Message) error {
+	return c.indicate(m)
+}
+
+func (c *Client) indicate(m *Message) error {
+	if !m.IsIndication() {
+		err := fmt.Sprintf("message class %s is not indication", m.Type.Class)
+		return errors.New(err)
+	}
+	if err := c.addConfigured(m); err != nil {
+		return err
+	}
+	if _, err := c.writeMessage(m, time.Time{}); err != nil {
+		return err
+	}
+	c.logEvent(LogEvent{Kind: LogRequestSent, ID: m.TransactionID, Type: m.Type})
 	return nil
 }
 
-func (c *Client) Call(m *Message, rto time.Time) (*XORMappedAddr ,error) {
-	var addr XORMappedAddr
+// encode m if it is not encoded and write it, returns the length of the encoded message.
+// no transaction is registered, so the response is passed to the handler of SetUnmatchedResponseHandler
+func (c *Client) WriteMessage(m *Message) (int, error) {
+	return c.writeMessage(m, time.Time{})
+}
+
+func (c *Client) writeMessage(m *Message, deadline time.Time) (int, error) {
+	return c.writeMessageTo(m, nil, deadline)
+}
+
+// writeMessage to addr, see writeTo
+func (c *Client) writeMessageTo(m *Message, addr net.Addr, deadline time.Time) (int, error) {
+	if len(m.Raw) < messageHeader {
+		m.Encode()
+	}
+	n := len(m.Raw)
+	if c.MTU > 0 && n > c.MTU && !c.Reliable {
+		err := fmt.Sprintf("message size(%d) exceeds MTU(%d)", n, c.MTU)
+		c.logEvent(LogEvent{Kind: LogOversize, ID: m.TransactionID, Type: m.Type, Size: n, Err: errors.New(err)})
+	}
+	if err := c.writeTo(m.Raw, addr, deadline); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// send m and block until the response or the deadline, returns the response.
+// the caller owns the response, and may call ReleaseMessage when it is done.
+// if the response is error response, its ERROR-CODE is returned as *StunError,
+// check it by errors.As or the Is* helpers like IsUnauthorized, the assertion err.(ErrorCodeAttribute) fails.
+// 300 Try Alternate is followed up to MaxRedirects, otherwise returned as *AlternateError
+func (c *Client) Do(m *Message, deadline time.Time) (*Message, error) {
+	return c.doRedirect(m, deadline, c.MaxRedirects)
+}
+
+func (c *Client) do(m *Message, deadline time.Time) (*Message, error) {
+	var (
+		res    *Message
+		resErr error
+		rtt    time.Duration
+	)
 
 	f := callbackPool.Get().(*CallbackHandle)
-	f.callback = func(msg MessageObj) {
-		if msg.Err != nil {
-			log.Fatal(msg.Err)
-		}
-		if err := addr.GetXORMapped(msg.Msg); err != nil {
-			log.Fatal(err)
+	f.callback = func(e MessageObj) {
+		if e.Err != nil {
+			resErr = e.Err
+			return
 		}
+		res = e.Msg // owned by the handler, it is not reused by the read loop
+		rtt = e.RTT
 	}
 
 	defer func() {
@@ -103,16 +254,85 @@ func (c *Client) Call(m *Message, rto time.Time) (*XORMappedAddr ,error) {
 	}()
 
 	// waiting TransactionLaunch until call callback func
-	if err := c.TransactionLaunch(m, f, rto); err != nil {
+	if err := c.TransactionLaunch(m, f, deadline); err != nil {
 		return nil, err
 	}
 	f.Wait()
 
+	if resErr != nil {
+		return nil, resErr
+	}
+	c.cacheRTO(rtt)
+
+	// error response is returned with ERROR-CODE, e.g. to read REALM and NONCE of 401
+	return res, responseError(res)
+}
+
+func (c *Client) Call(m *Message, rto time.Time) (*XORMappedAddress, error) {
+	res, err := c.Do(m, rto)
+	if err != nil {
+		return nil, err
+	}
+
+	var addr XORMappedAddress
+	if err := addr.GetFrom(res); err != nil {
+		return nil, err
+	}
+
 	return &addr, nil
 }
 
-// write the m.Raw=request to conn
-func (m *Message) WriteTo(w io.Writer) error {
-	_, err := w.Write(m.Raw)
-	return err
+// send Binding request, and returns the reflexive address of c as *net.UDPAddr.
+// MAPPED-ADDRESS and the legacy XOR-MAPPED-ADDRESS are used if the server does not return XOR-MAPPED-ADDRESS
+func (c *Client) Bind(deadline time.Time) (net.Addr, error) {
+	m, err := Build(TransactionID, BindingRequest)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.Do(m, deadline)
+	if err != nil {
+		return nil, err
+	}
+	defer ReleaseMessage(res)
+
+	return res.ReflexiveAddress()
+}
+
+// returns the public address of this host which is seen by the STUN server of addr
+func Discover(addr string) (net.Addr, error) {
+	c, err := Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	return c.Bind(c.clock.Now().Add(defaultTransactionTimeout))
+}
+
+// launch the transaction of m, h is called with ctx.Err() if ctx is done before the response.
+// the deadline of ctx is used as the transaction timeout
+func (c *Client) DoContext(ctx context.Context, m *Message, h Handler) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline() // zero time, if no deadline
+
+	f := &contextHandle{
+		h:    h,
+		done: make(chan struct{}),
+	}
+	if err := c.TransactionLaunch(m, f, deadline); err != nil {
+		return err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			// the transaction may be already processed, then CancelHandle returns err
+			c.agent.CancelHandle(m.TransactionID, ctx.Err())
+		case <-f.done:
+		}
+	}()
+
+	return nil
 }
@@ -0,0 +1,174 @@
+package gostun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+/*
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |         Channel Number        |            Length             |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |                                                               |
+   /                       Application Data                        /
+   /                                                               /
+   |                                                               |
+   |                               +-------------------------------+
+   |                               |
+   +-------------------------------+
+
+                      Format of ChannelData Message
+
+   The ChannelData message is not a STUN message.  The channel number is
+   in the range 0x4000 through 0x7FFF, so the first two bits are 0b01,
+   while the first two bits of a STUN message are 0b00.  The read loop
+   uses this to distinguish them.  Only the datagram read loops handle
+   ChannelData, the framed read of stream transports expects STUN messages.
+*/
+
+const (
+	channelDataHeader = 4
+	minChannelNumber  = 0x4000
+	maxChannelNumber  = 0x7FFE // 0x7FFF is reserved
+	channelNumberSize = 4      // number and RFFU
+)
+
+type ChannelData struct {
+	Number uint16
+	Data   []byte
+}
+
+// the first two bits of b are 0b01
+func isChannelData(b []byte) bool {
+	return len(b) >= channelDataHeader && b[0]&0xc0 == 0x40
+}
+
+func validChannelNumber(n uint16) bool {
+	return n >= minChannelNumber && n <= maxChannelNumber
+}
+
+// returns ChannelData message, which is padded to 4 bytes for TCP
+func (d *ChannelData) Encode() []byte {
+	b := make([]byte, channelDataHeader+paddingLength(len(d.Data)))
+	binary.BigEndian.PutUint16(b[0:2], d.Number)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(d.Data)))
+	copy(b[channelDataHeader:], d.Data)
+	return b
+}
+
+// decode ChannelData message b, d.Data shares b
+func (d *ChannelData) Decode(b []byte) error {
+	if !isChannelData(b) {
+		return errors.New("not ChannelData message")
+	}
+	n, err := getU16(b, 0)
+	if err != nil {
+		return err
+	}
+	length, err := getU16(b, 2)
+	if err != nil {
+		return err
+	}
+	l := int(length)
+	if len(b) < channelDataHeader+l {
+		err := fmt.Sprintf("ChannelData length(%d) is more than %d", l, len(b)-channelDataHeader)
+		return errors.New(err)
+	}
+	d.Number = n
+	d.Data = b[channelDataHeader : channelDataHeader+l]
+	return nil
+}
+
+type ChannelNumber uint16
+
+func (n ChannelNumber) AddTo(m *Message) error {
+	if !validChannelNumber(uint16(n)) {
+		err := fmt.Sprintf("channel number 0x%x is out of range", uint16(n))
+		return errors.New(err)
+	}
+	v := make([]byte, channelNumberSize)
+	putU16(v, 0, uint16(n))
+	return m.Add(CHANNEL_NUMBER, v)
+}
+
+func (n *ChannelNumber) GetFrom(m *Message) error {
+	v, err := m.GetRapped(CHANNEL_NUMBER)
+	if err != nil {
+		return err
+	}
+	if len(v) != channelNumberSize {
+		err := fmt.Sprintf("CHANNEL-NUMBER length(%d) is not %d", len(v), channelNumberSize)
+		return errors.New(err)
+	}
+	number, err := getU16(v, 0)
+	if err != nil {
+		return err
+	}
+	*n = ChannelNumber(number)
+	return nil
+}
+
+// bind channel to peer on the allocation
+func (c *Client) ChannelBind(channel uint16, peer net.Addr) error {
+	addr, err := peerAddress(peer)
+	if err != nil {
+		return err
+	}
+
+	m := new(Message)
+	if err := m.Build(TransactionID, ChannelBindRequest); err != nil {
+		return err
+	}
+	if err := ChannelNumber(channel).AddTo(m); err != nil {
+		return err
+	}
+	if err := addr.AddTo(m); err != nil {
+		return err
+	}
+	_, err = c.doAllocation(m)
+	return err
+}
+
+// send data to the peer bound to channel
+func (c *Client) SendChannelData(channel uint16, data []byte) error {
+	if !validChannelNumber(channel) {
+		err := fmt.Sprintf("channel number 0x%x is out of range", channel)
+		return errors.New(err)
+	}
+	d := ChannelData{
+		Number: channel,
+		Data:   data,
+	}
+	return c.write(d.Encode(), time.Time{})
+}
+
+// h is called with ChannelData messages of the read loop, d.Data must not be kept
+func (c *Client) SetChannelDataHandler(h func(d ChannelData)) {
+	c.rw.Lock()
+	c.channelHandler = h
+	c.rw.Unlock()
+}
+
+// dispatch ChannelData message b, returns false if b is not ChannelData
+func (c *Client) processChannelData(b []byte) bool {
+	if !isChannelData(b) {
+		return false
+	}
+	var d ChannelData
+	if err := d.Decode(b); err != nil {
+		return false
+	}
+
+	c.rw.RLock()
+	h := c.channelHandler
+	c.rw.RUnlock()
+	if h != nil {
+		h(d)
+	}
+	return true
+}
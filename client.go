@@ -1,25 +1,62 @@
 package gostun
 
 import (
+	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net"
 	"sync"
 	"time"
 )
 
+// Client is safe for concurrent use by multiple goroutines, e.g. Do and Indicate at once.
+// the writes of conn are serialized, so the messages on TCP are not interleaved
 type Client struct {
-	conn        Connection
-	TimeoutRate time.Duration
-	wg          sync.WaitGroup
-	close       chan struct{}
-	agent       Handle
+	conn Connection
+	clientConfig
+	wg             sync.WaitGroup
+	wmux           sync.Mutex // serializes writes of conn
+	close          chan struct{}
+	rate           chan time.Duration // new interval of timeoutUntil by SetTimeoutRate
+	errs           chan error         // fatal errors of the loops, see Errors
+	agent          Handle
+	rw             sync.RWMutex // guards closed, alloc, channelHandler, logger, metrics and timeoutRate
+	closed         bool
+	alloc          *allocation         // TURN allocation
+	channelHandler func(d ChannelData) // ChannelData of TURN
+	logger         Logger
+	metrics        Metrics
+	timeoutRate    time.Duration // of the last SetTimeoutRate, 0 is TimeoutRate
+	clock          Clock         // set by WithClock before the loops are started
+}
+
+// options of Client, which are copied to the client of the alternate server
+type clientConfig struct {
+	TimeoutRate        time.Duration // interval of the timeout sweep, read when the loops start, use WithTimeoutRate
+	RTO                time.Duration // initial retransmission timeout
+	MaxRetries         int           // Rc, count of the requests including the first one, 0 disables retransmissions
+	Software           string        // SOFTWARE of requests, not added if empty
+	AddFingerprint     bool          // add FINGERPRINT to requests and indications
+	RequireFingerprint bool          // drop the messages without valid FINGERPRINT, e.g. on the socket shared with RTP
+	Reliable           bool          // stream transport (TCP/TLS), messages are framed and not retransmitted
+	MaxRedirects       int           // max count of following ALTERNATE-SERVER, 0 disables
+	MaxMessageSize     int           // size of the read buffer of datagrams
+	MTU                int           // larger messages are logged as LogOversize, since they are fragmented over UDP
+	AutoRefresh        bool          // refresh the TURN allocation by Allocate until Close
+	KeepAliveRefresh   bool          // StartKeepAlive sends Refresh of the TURN allocation, instead of Binding indication
+	rtoCache           *rtoCache
+	integrity          MessageIntegrity // short-term credential of WithShortTermAuth
 }
 
 type Handle interface {
-	ProcessHandle(*Message) error
+	ProcessHandle(*Message, net.Addr) error
 	TimeOutHandle(time.Time) error
-	TransactionHandle([TransactionIDSize]byte, Handler, time.Time) error
+	Start([TransactionIDSize]byte, time.Time, Handler, interface{}) error
+	Stop([TransactionIDSize]byte) error
+	CancelHandle([TransactionIDSize]byte, error) error
+	ScheduleHandle([TransactionIDSize]byte, []byte, time.Duration, int) error
+	RetransmitHandle(time.Time) ([][]byte, error)
+	Close() error
 }
 
 type Connection interface {
@@ -28,26 +65,141 @@ type Connection interface {
 	io.Closer
 }
 
-const defaultTimeoutRate = time.Millisecond * 100
+const (
+	defaultTimeoutRate = time.Millisecond * 100
+
+	// IPv6 minimum MTU, which is commonly used in ICE
+	defaultMaxMessageSize = 1280
+	defaultMTU            = 1280
+
+	// each loop fails at most once, the rest is for the future loops
+	errorsBuffer = 4
+)
+
+// Connection of unconnected socket, which writes to raddr
+type packetConnection struct {
+	net.PacketConn
+	raddr net.Addr
+}
+
+func (p packetConnection) Write(b []byte) (int, error) {
+	return p.WriteTo(b, p.raddr)
+}
+
+func (p packetConnection) Read(b []byte) (int, error) {
+	n, _, err := p.ReadFrom(b)
+	return n, err
+}
 
-func Dial(network, addr string) (*Client, error) {
+func (p packetConnection) RemoteAddr() net.Addr {
+	return p.raddr
+}
+
+func Dial(network, addr string, opts ...Option) (*Client, error) {
 	conn, err := net.Dial(network, addr)
 	if err != nil {
 		return nil, err
 	}
-	return NewClient(conn)
+	c, err := NewClient(conn, opts...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Dial with the local address laddr, e.g. the host candidate of ICE. nil laddr is chosen automatically
+func DialLocal(network string, laddr, raddr *net.UDPAddr, opts ...Option) (*Client, error) {
+	conn, err := net.DialUDP(network, laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(conn, opts...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// local address of the socket of c, nil if conn has no local address
+func (c *Client) LocalAddr() net.Addr {
+	l, ok := c.conn.(interface {
+		LocalAddr() net.Addr
+	})
+	if !ok {
+		return nil
+	}
+	return l.LocalAddr()
 }
 
-func NewClient(conn net.Conn) (*Client, error) {
-	c := &Client{
-		conn:        conn,
-		agent:       NewAgent(),
-		TimeoutRate: defaultTimeoutRate,
+func newClient(conn Connection) *Client {
+	return &Client{
+		conn:  conn,
+		agent: NewAgent(),
+		clientConfig: clientConfig{
+			TimeoutRate:    defaultTimeoutRate,
+			RTO:            defaultRTO,
+			MaxRetries:     defaultMaxRetries,
+			MaxRedirects:   defaultMaxRedirects,
+			MaxMessageSize: defaultMaxMessageSize,
+			MTU:            defaultMTU,
+			rtoCache:       newRTOCache(),
+		},
+		metrics: nopMetrics{},
+		clock:   realClock{},
+		close:   make(chan struct{}),
+		rate:    make(chan time.Duration),
+		errs:    make(chan error, errorsBuffer),
 	}
+}
+
+// opts are applied before the loops of the client are started
+func NewClient(conn net.Conn, opts ...Option) (*Client, error) {
+	c := newClient(conn)
+	c.Reliable = isReliable(conn)
+	if err := c.apply(opts); err != nil {
+		return nil, err
+	}
+	c.run()
+
+	return c, nil
+}
 
+// start the loops of connected conn, options must be set before
+func (c *Client) run() {
 	c.wg.Add(2)
 	go c.readDecode() // Decode Message
-	go c.timeoutUntil()
+	go c.timeoutUntil(c.clock.NewTicker(c.TimeoutRate))
+}
+
+// start the loops of pr which has the source addresses, options must be set before
+func (c *Client) runPacket(pr packetReader) {
+	c.wg.Add(2)
+	go c.readPacket(pr) // Decode Message with source address
+	go c.timeoutUntil(c.clock.NewTicker(c.TimeoutRate))
+}
+
+// TCP and TLS over TCP are reliable, RTO retransmission only applies to UDP
+func isReliable(conn net.Conn) bool {
+	switch conn.LocalAddr().Network() {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return true
+	}
+	return false
+}
+
+// client of unconnected socket pc, requests are written to raddr
+func NewClientPacket(pc net.PacketConn, raddr net.Addr, opts ...Option) (*Client, error) {
+	c := newClient(packetConnection{
+		PacketConn: pc,
+		raddr:      raddr,
+	})
+	if err := c.apply(opts); err != nil {
+		return nil, err
+	}
+
+	c.runPacket(pc)
 
 	return c, nil
 }
@@ -55,33 +207,328 @@ func NewClient(conn net.Conn) (*Client, error) {
 func (c *Client) readDecode() {
 	defer c.wg.Done()
 
-	m := new(Message)
-	m.Raw = make([]byte, 1024)
+	from := remoteAddr(c.conn) // connected, all messages come from the server
 
-	_, err := m.ReadConn(c.conn) // read and decode message
-	if err == nil {
-		if processErr := c.agent.ProcessHandle(m); processErr == ErrAgent {
+	for {
+		m := AcquireMessage() // owned by the handler after ProcessHandle
+		var (
+			n   int
+			err error
+		)
+		if c.Reliable {
+			// one message of the stream, it may be split across the reads of conn
+			var l int64
+			l, err = m.ReadFrom(c.conn)
+			n = int(l)
+		} else {
+			m.grow(c.MaxMessageSize)
+			n, err = m.ReadConn(c.conn) // read and decode message
+		}
+		if c.isClosed() {
+			ReleaseMessage(m)
+			return
+		}
+		if isFatalReadErr(err) {
+			ReleaseMessage(m)
+			c.closeOnError(err)
+			return
+		}
+		if isTimeout(err) {
+			ReleaseMessage(m)
+			continue
+		}
+		c.getMetrics().BytesRead(n)
+		if err == ErrNotSTUN && c.Reliable {
+			// the next header can't be found in the stream anymore
+			ReleaseMessage(m)
+			c.closeOnError(err)
+			return
+		}
+		if (err == ErrNotSTUN || err == ErrBufferTooSmall) && !c.Reliable && c.processChannelData(m.Raw) {
+			ReleaseMessage(m)
+			continue
+		}
+		if err != nil {
+			ReleaseMessage(m)
+			c.logEvent(LogEvent{Kind: LogDecodeError, From: from, Err: err})
+			continue
+		}
+		if err := c.checkFingerprint(m); err != nil {
+			ReleaseMessage(m)
+			c.logEvent(LogEvent{Kind: LogDecodeError, From: from, Err: err})
+			continue
+		}
+		c.logResponse(m, from)
+		if !c.process(m, from) {
 			return
 		}
-	} else {
-		log.Print(err)
 	}
 }
 
-func (c *Client) timeoutUntil() {
-	t := time.NewTicker(c.TimeoutRate) // rto
+// messages of the other protocol on the shared socket may be decoded as STUN,
+// so FINGERPRINT distinguishes them if RequireFingerprint
+func (c *Client) checkFingerprint(m *Message) error {
+	if !c.RequireFingerprint {
+		return nil
+	}
+	if _, ok := m.Get(FINGERPRINT); !ok {
+		return ErrFingerprintRequired
+	}
+	return FingerprintAttr.Check(m)
+}
+
+// read loop of unconnected socket, messages may come from any peer
+// reader of the datagrams and their source addresses, e.g. net.PacketConn
+type packetReader interface {
+	ReadFrom(b []byte) (int, net.Addr, error)
+}
+
+func (c *Client) readPacket(pc packetReader) {
+	defer c.wg.Done()
+
+	for {
+		m := AcquireMessage() // owned by the handler after ProcessHandle
+		m.grow(c.MaxMessageSize)
+		n, addr, err := pc.ReadFrom(m.Raw)
+		if c.isClosed() {
+			ReleaseMessage(m)
+			return
+		}
+		if err != nil {
+			ReleaseMessage(m)
+			if isFatalReadErr(err) {
+				c.closeOnError(err)
+				return
+			}
+			if !isTimeout(err) {
+				c.logEvent(LogEvent{Kind: LogReadError, Err: err})
+			}
+			continue
+		}
+		c.getMetrics().BytesRead(n)
+		full := n == len(m.Raw)
+		m.Raw = m.Raw[:n]
+		if c.processChannelData(m.Raw) {
+			ReleaseMessage(m)
+			continue
+		}
+		if full && m.truncated() {
+			ReleaseMessage(m)
+			c.logEvent(LogEvent{Kind: LogDecodeError, From: addr, Err: ErrMessageTruncated})
+			continue
+		}
+		if err := m.Decode(); err != nil {
+			ReleaseMessage(m)
+			c.logEvent(LogEvent{Kind: LogDecodeError, From: addr, Err: err})
+			continue
+		}
+		if err := c.checkFingerprint(m); err != nil {
+			ReleaseMessage(m)
+			c.logEvent(LogEvent{Kind: LogDecodeError, From: addr, Err: err})
+			continue
+		}
+		c.logResponse(m, addr)
+		if !c.process(m, addr) {
+			return
+		}
+	}
+}
+
+// h is called with the unsolicited messages, e.g. TURN Data indications and
+// ICE connectivity checks on the shared socket. h owns MessageObj.Msg,
+// and may answer the requests by MessageObj.Respond
+func (c *Client) SetHandler(h Handler) {
+	if h != nil {
+		h = responder{c: c, h: h}
+	}
+	if a, ok := c.agent.(interface {
+		SetHandler(Handler)
+	}); ok {
+		a.SetHandler(h)
+	}
+}
+
+// h is called with the requests and indications from the peer, and may answer them by MessageObj.Respond
+func (c *Client) SetRequestHandler(h Handler) {
+	if h != nil {
+		h = responder{c: c, h: h}
+	}
+	if a, ok := c.agent.(interface {
+		SetRequestHandler(Handler)
+	}); ok {
+		a.SetRequestHandler(h)
+	}
+}
+
+// h is called with the responses of non-registered transactions, e.g. the late responses after the timeout
+func (c *Client) SetUnmatchedResponseHandler(h Handler) {
+	if a, ok := c.agent.(interface {
+		SetUnmatchedResponseHandler(Handler)
+	}); ok {
+		a.SetUnmatchedResponseHandler(h)
+	}
+}
+
+// duplicate responses of the finished transactions are dropped for d, instead of passed to SetUnmatchedResponseHandler
+func (c *Client) SetDuplicateWindow(d time.Duration) {
+	if a, ok := c.agent.(interface {
+		SetDuplicateWindow(time.Duration)
+	}); ok {
+		a.SetDuplicateWindow(d)
+	}
+}
+
+// transactions of c are limited to n, ErrTooManyTransactions is returned over it. 0 is unlimited
+func (c *Client) SetMaxTransactions(n int) {
+	if a, ok := c.agent.(interface {
+		SetMaxTransactions(int)
+	}); ok {
+		a.SetMaxTransactions(n)
+	}
+}
+
+// pass m to the agent, and reports whether the read loop should continue.
+// an error of a single message does not stop the loop, only the closed agent does
+func (c *Client) process(m *Message, from net.Addr) bool {
+	id := m.TransactionID // m is owned by the handler after ProcessHandle
+	err := c.agent.ProcessHandle(m, from)
+	if err == ErrAgent {
+		return false
+	}
+	if err != nil {
+		c.logEvent(LogEvent{Kind: LogHandleError, ID: id, From: from, Err: err})
+	}
+	return true
+}
+
+// the connection can't be read anymore, e.g. the peer is disconnected
+// or conn is closed outside of the client
+func isFatalReadErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+// read deadline of conn is passed, the loop continues
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// a loop is stopped by err, so close the client not to leave the
+// pending transactions and the other loop running.
+// Close waits for the loops, so it is called in another goroutine
+func (c *Client) closeOnError(err error) {
+	c.logEvent(LogEvent{Kind: LogLoopError, Err: err})
+	select {
+	case c.errs <- err:
+	default: // nobody receives, the error is dropped
+	}
+	go c.Close()
+}
+
+// errors which stopped the read or timeout loop, the client is closed after each of them.
+// sends are non-blocking, so the channel need not be received and the values may be dropped.
+// the channel is not closed by Close
+func (c *Client) Errors() <-chan error {
+	return c.errs
+}
+
+// t is created by the constructor from TimeoutRate, so TimeoutRate is not read concurrently
+// and the ticker of FakeClock exists when the constructor returns
+func (c *Client) timeoutUntil(t Ticker) {
 	defer c.wg.Done()
 	for {
 		select {
 		case <-c.close:
 			t.Stop()
 			return
-		case trate := <-t.C:
+		case d := <-c.rate:
+			t.Stop()
+			t = c.clock.NewTicker(d)
+		case trate := <-t.C():
 			err := c.agent.TimeOutHandle(trate)
-			if err == nil || err == ErrAgent {
-				return
+			if err == nil {
+				err = c.retransmit(trate)
+			}
+			if err == nil {
+				continue
 			}
-			panic(err)
+			if err != ErrAgent {
+				c.closeOnError(err)
+			}
+			return
+		}
+	}
+}
+
+// change the interval of the timeout and retransmission sweep of the running client.
+// TimeoutRate is not updated, it is the rate when the loops are started
+func (c *Client) SetTimeoutRate(d time.Duration) error {
+	if d <= 0 {
+		err := fmt.Sprintf("timeout rate(%s) is not positive", d)
+		return errors.New(err)
+	}
+	select {
+	case c.rate <- d:
+		c.rw.Lock()
+		c.timeoutRate = d
+		c.rw.Unlock()
+		return nil
+	case <-c.close:
+		return ErrAgent
+	}
+}
+
+// stop the read and timeout loops, and close conn.
+// the pending transactions are called with ErrAgent
+func (c *Client) Close() error {
+	c.rw.Lock()
+	if c.closed {
+		c.rw.Unlock()
+		return ErrAgent
+	}
+	c.closed = true
+	c.rw.Unlock()
+
+	close(c.close)
+	// a pending Read of some Connection is not unblocked by Close, so expire it first
+	if d, ok := c.conn.(interface {
+		SetReadDeadline(time.Time) error
+	}); ok {
+		d.SetReadDeadline(time.Now())
+	}
+	connErr := c.conn.Close()
+	// pending transactions are finished before waiting, since a goroutine of c may wait for them
+	agentErr := c.agent.Close()
+	c.wg.Wait()
+
+	if connErr != nil {
+		return connErr
+	}
+	return agentErr
+}
+
+func (c *Client) isClosed() bool {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+	return c.closed
+}
+
+// re-send the requests whose RTO is passed
+func (c *Client) retransmit(trate time.Time) error {
+	raws, err := c.agent.RetransmitHandle(trate)
+	if err != nil {
+		return err
+	}
+	for _, raw := range raws {
+		if err := c.write(raw, time.Time{}); err != nil {
+			c.logEvent(LogEvent{Kind: LogWriteError, Err: err})
 		}
 	}
+	return nil
 }
@@ -0,0 +1,503 @@
+package gostun
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// client connected to the returned peer by Pipe, closed at the end of the test
+func testClient(t *testing.T, opts ...Option) (*Client, *MemConn) {
+	t.Helper()
+	a, b := Pipe()
+	c, err := NewClient(a, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		b.Close()
+	})
+	return c, b
+}
+
+// read the next request which peer received
+func readRequest(t *testing.T, peer *MemConn) *Message {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(time.Second * 5))
+	m := &Message{Raw: make([]byte, defaultMaxMessageSize)}
+	n, err := peer.Read(m.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Raw = m.Raw[:n]
+	if err := m.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// encoded response of type typ to req
+func response(t *testing.T, req *Message, typ MessageType, s ...Setter) []byte {
+	t.Helper()
+	m := &Message{TransactionID: req.TransactionID}
+	if err := m.Build(append([]Setter{typ}, s...)...); err != nil {
+		t.Fatal(err)
+	}
+	return m.Raw
+}
+
+// the read loop reuses its buffers, the message given to the first handler must be kept
+func TestClientMessageKeptAfterNextRead(t *testing.T) {
+	c, peer := testClient(t)
+	first := make(eventHandler, 1)
+	second := make(eventHandler, 1)
+	deadline := time.Now().Add(time.Second * 5)
+	if err := c.TransactionLaunch(MessageBuild(TransactionID, BindingRequest), first, deadline); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.TransactionLaunch(MessageBuild(TransactionID, BindingRequest), second, deadline); err != nil {
+		t.Fatal(err)
+	}
+	r1 := response(t, readRequest(t, peer), BindingSuccess,
+		&XORMappedAddress{IP: net.IPv4(192, 0, 2, 1), Port: 1000})
+	r2 := response(t, readRequest(t, peer), BindingSuccess,
+		&XORMappedAddress{IP: net.IPv4(198, 51, 100, 2), Port: 2000})
+	peer.Write(r1)
+	peer.Write(r2)
+
+	e := first.next(t)
+	second.next(t)
+	if e.Err != nil {
+		t.Fatal(e.Err)
+	}
+	if !bytes.Equal(e.Msg.Raw, r1) {
+		t.Fatalf("first message is %x, want %x", e.Msg.Raw, r1)
+	}
+	var addr XORMappedAddress
+	if err := addr.GetFrom(e.Msg); err != nil {
+		t.Fatal(err)
+	}
+	if !addr.IP.Equal(net.IPv4(192, 0, 2, 1)) || addr.Port != 1000 {
+		t.Fatalf("first address is %s:%d", addr.IP, addr.Port)
+	}
+}
+
+func TestMessageClone(t *testing.T) {
+	m := MessageBuild(TransactionID, BindingSuccess, &XORMappedAddress{IP: net.IPv4(192, 0, 2, 1), Port: 1000})
+	b := m.Clone()
+	raw := append([]byte(nil), m.Raw...)
+	for i := range m.Raw {
+		m.Raw[i] = 0xff
+	}
+	if !bytes.Equal(b.Raw, raw) {
+		t.Fatalf("clone is %x, want %x", b.Raw, raw)
+	}
+	if !bytes.Equal(b.Attributes[0].Value, raw[messageHeader+attributeHeader:]) {
+		t.Fatal("attribute value of clone shares the original")
+	}
+}
+
+// the writes of the goroutines must not interleave on the stream, run with -race
+func TestClientConcurrentDo(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c, err := NewClient(a, WithReliable(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go func() {
+		for {
+			m := new(Message)
+			if _, err := m.ReadFrom(b); err != nil {
+				return // closed, or the framing is broken
+			}
+			if m.Type.Class != ClassRequest {
+				continue
+			}
+			r := &Message{TransactionID: m.TransactionID}
+			r.Build(BindingSuccess, &XORMappedAddress{IP: net.IPv4(192, 0, 2, 1), Port: 1000})
+			if _, err := b.Write(r.Raw); err != nil {
+				return
+			}
+		}
+	}()
+
+	const goroutines, requests = 16, 20
+	errs := make(chan error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			for j := 0; j < requests; j++ {
+				if err := c.Indicate(MessageBuild(TransactionID, BindingIndication)); err != nil {
+					errs <- err
+					return
+				}
+				r, err := c.Do(MessageBuild(TransactionID, BindingRequest), time.Now().Add(time.Second*5))
+				if err != nil {
+					errs <- err
+					return
+				}
+				ReleaseMessage(r)
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < goroutines; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClientUnexpectedResponse(t *testing.T) {
+	c, peer := testClient(t)
+	h := make(eventHandler, 1)
+	if err := c.TransactionLaunch(MessageBuild(TransactionID, BindingRequest), h, time.Now().Add(time.Second*5)); err != nil {
+		t.Fatal(err)
+	}
+	peer.Write(response(t, readRequest(t, peer), NewMessageType(MethodAllocate, ClassSuccessResponse)))
+	if e := h.next(t); e.Err != ErrUnexpectedResponse {
+		t.Fatalf("err is %v, want %v", e.Err, ErrUnexpectedResponse)
+	}
+}
+
+// h of DoContext is called with ctx.Err() if ctx is done before the response, and the late response is dropped
+func TestDoContextCancelled(t *testing.T) {
+	c, peer := testClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	h := make(eventHandler, 2)
+	if err := c.DoContext(ctx, MessageBuild(TransactionID, BindingRequest), h); err != nil {
+		t.Fatal(err)
+	}
+	req := readRequest(t, peer)
+	cancel()
+	if e := h.next(t); e.Err != context.Canceled {
+		t.Fatalf("err is %v, want %v", e.Err, context.Canceled)
+	}
+	peer.Write(response(t, req, BindingSuccess))
+	time.Sleep(time.Millisecond * 100)
+	h.none(t)
+
+	if err := c.DoContext(ctx, MessageBuild(TransactionID, BindingRequest), h); err != context.Canceled {
+		t.Fatalf("err of the done ctx is %v, want %v", err, context.Canceled)
+	}
+}
+
+// cancel after the response doesn't call h again
+func TestDoContextCancelAfterResponse(t *testing.T) {
+	c, peer := testClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	h := make(eventHandler, 2)
+	if err := c.DoContext(ctx, MessageBuild(TransactionID, BindingRequest), h); err != nil {
+		t.Fatal(err)
+	}
+	peer.Write(response(t, readRequest(t, peer), BindingSuccess))
+	if e := h.next(t); e.Err != nil || e.Msg == nil {
+		t.Fatalf("event is %+v", e)
+	}
+	cancel()
+	time.Sleep(time.Millisecond * 100)
+	h.none(t)
+}
+
+// the transaction of ctx without deadline is not timed out
+func TestDoContextNoDeadline(t *testing.T) {
+	clk := NewFakeClock(time.Unix(1000, 0))
+	c, peer := testClient(t, WithClock(clk), WithMaxRetries(0))
+	h := make(eventHandler, 1)
+	if err := c.DoContext(context.Background(), MessageBuild(TransactionID, BindingRequest), h); err != nil {
+		t.Fatal(err)
+	}
+	req := readRequest(t, peer)
+	clk.Advance(time.Hour)
+	time.Sleep(time.Millisecond * 100)
+	h.none(t)
+	peer.Write(response(t, req, BindingSuccess))
+	if e := h.next(t); e.Err != nil {
+		t.Fatal(e.Err)
+	}
+}
+
+// the goroutine which waits ctx exits after h is called, even though ctx is never done
+func TestDoContextGoroutineExits(t *testing.T) {
+	c, peer := testClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	before := runtime.NumGoroutine()
+	h := make(eventHandler, 1)
+	if err := c.DoContext(ctx, MessageBuild(TransactionID, BindingRequest), h); err != nil {
+		t.Fatal(err)
+	}
+	peer.Write(response(t, readRequest(t, peer), BindingSuccess))
+	h.next(t)
+	for deadline := time.Now().Add(time.Second * 5); runtime.NumGoroutine() > before; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines, want %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// the request over SetMaxTransactions is not sent
+func TestClientMaxTransactions(t *testing.T) {
+	c, peer := testClient(t)
+	c.SetMaxTransactions(1)
+	h := make(eventHandler, 2)
+	deadline := time.Now().Add(time.Second * 5)
+	if err := c.TransactionLaunch(MessageBuild(TransactionID, BindingRequest), h, deadline); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.TransactionLaunch(MessageBuild(TransactionID, BindingRequest), h, deadline); err != ErrTooManyTransactions {
+		t.Fatalf("err is %v, want %v", err, ErrTooManyTransactions)
+	}
+	peer.Write(response(t, readRequest(t, peer), BindingSuccess))
+	if e := h.next(t); e.Err != nil {
+		t.Fatal(e.Err)
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	if n, err := peer.Read(make([]byte, defaultMaxMessageSize)); err == nil {
+		t.Fatalf("the second request of %d bytes is sent", n)
+	}
+}
+
+// the requests and indications are signed by the options, FINGERPRINT is the last attribute
+func TestClientSignOptions(t *testing.T) {
+	c, peer := testClient(t, WithShortTermAuth("password"), WithFingerprint(), WithSoftware("software"))
+	if err := c.Indicate(MessageBuild(TransactionID, BindingIndication)); err != nil {
+		t.Fatal(err)
+	}
+	h := make(eventHandler, 1)
+	if err := c.TransactionLaunch(MessageBuild(TransactionID, BindingRequest), h, time.Now().Add(time.Second*5)); err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range []MessageType{BindingIndication, BindingRequest} {
+		m := readRequest(t, peer)
+		if m.Type != typ {
+			t.Fatalf("message is %s, want %s", m.Type, typ)
+		}
+		if s, _ := m.Get(SOFTWARE); string(s.Value) != "software" {
+			t.Fatalf("%s: SOFTWARE is %q", typ, s.Value)
+		}
+		if err := NewShortTermIntegrity("password").Check(m); err != nil {
+			t.Fatalf("%s: %v", typ, err)
+		}
+		if !m.hasFingerprint() {
+			t.Fatalf("%s: FINGERPRINT is not the last attribute", typ)
+		}
+		if err := FingerprintAttr.Check(m); err != nil {
+			t.Fatalf("%s: %v", typ, err)
+		}
+	}
+}
+
+// NewClient returns the error of the invalid option
+func TestClientInvalidOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opt  Option
+	}{
+		{"timeout rate", WithTimeoutRate(0)},
+		{"RTO", WithRTO(-time.Second)},
+		{"max retries", WithMaxRetries(-1)},
+		{"SOFTWARE", WithSoftware(string(make([]byte, maxSoftware+1)))},
+		{"max message size", WithMaxMessageSize(messageHeader - 1)},
+		{"MTU", WithMTU(-1)},
+		{"short-term password", WithShortTermAuth("")},
+		{"max transactions", WithMaxTransactions(-1)},
+		{"clock", WithClock(nil)},
+	} {
+		a, b := Pipe()
+		if c, err := NewClient(a, tc.opt); err == nil {
+			c.Close()
+			t.Errorf("no error of %s", tc.name)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+// the options are applied before the loops are started
+func TestClientOptions(t *testing.T) {
+	c, _ := testClient(t, WithTimeoutRate(time.Millisecond*50), WithRTO(time.Second), WithMaxRetries(3),
+		WithMaxMessageSize(600), WithMTU(500), WithRequireFingerprint())
+	if c.TimeoutRate != time.Millisecond*50 || c.RTO != time.Second || c.MaxRetries != 3 ||
+		c.MaxMessageSize != 600 || c.MTU != 500 || !c.RequireFingerprint {
+		t.Fatalf("options are %+v", c.clientConfig)
+	}
+}
+
+// WithRequireFingerprint drops the responses without valid FINGERPRINT, the transaction waits the valid one
+func TestClientRequireFingerprint(t *testing.T) {
+	l := make(eventLogger, 8)
+	c, peer := testClient(t, WithRequireFingerprint(), WithLogger(l))
+	h := make(eventHandler, 1)
+	if err := c.TransactionLaunch(MessageBuild(TransactionID, BindingRequest), h, time.Now().Add(time.Second*5)); err != nil {
+		t.Fatal(err)
+	}
+	req := readRequest(t, peer)
+
+	peer.Write(response(t, req, BindingSuccess))
+	if e := l.next(t, LogDecodeError); e.Err != ErrFingerprintRequired {
+		t.Fatalf("err is %v, want %v", e.Err, ErrFingerprintRequired)
+	}
+	corrupted := response(t, req, BindingSuccess, FingerprintAttr)
+	corrupted[len(corrupted)-1] ^= 0xff
+	peer.Write(corrupted)
+	if e := l.next(t, LogDecodeError); e.Err != ErrFingerprintMismatch {
+		t.Fatalf("err is %v, want %v", e.Err, ErrFingerprintMismatch)
+	}
+	h.none(t)
+
+	peer.Write(response(t, req, BindingSuccess, FingerprintAttr))
+	if e := h.next(t); e.Err != nil {
+		t.Fatal(e.Err)
+	}
+}
+
+// the keepalive is a Binding indication on each tick of the interval
+func TestClientKeepAlive(t *testing.T) {
+	clk := NewFakeClock(time.Unix(1000, 0))
+	c, peer := testClient(t, WithClock(clk))
+	c.StartKeepAlive(time.Second)
+	for i := 0; i < 2; i++ {
+		clk.Advance(time.Second)
+		if m := readRequest(t, peer); m.Type != BindingIndication {
+			t.Fatalf("keepalive is %s, want %s", m.Type, BindingIndication)
+		}
+	}
+}
+
+// KeepAliveRefresh refreshes the allocation instead of the indication
+func TestClientKeepAliveRefresh(t *testing.T) {
+	clk := NewFakeClock(time.Unix(1000, 0))
+	c, peer := testClient(t, WithClock(clk), WithMaxRetries(0))
+	c.KeepAliveRefresh = true
+	reqs := serveTURN(peer)
+	if _, _, err := c.Allocate("user", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	nextTURN(t, reqs, MethodAllocate)
+
+	c.StartKeepAlive(time.Second)
+	clk.Advance(time.Second)
+	m := nextTURN(t, reqs, MethodRefresh)
+	var l Lifetime
+	if err := l.GetFrom(m); err != nil || time.Duration(l) != keepAliveLifetime {
+		t.Fatalf("LIFETIME is %s, %v", time.Duration(l), err)
+	}
+}
+
+// Connection whose Read returns the error of fail, e.g. the stream is broken
+type failConn struct {
+	*MemConn
+	fail chan error
+}
+
+func (c failConn) Read(b []byte) (int, error) {
+	return 0, <-c.fail
+}
+
+// the fatal error of the read loop is sent to Errors, and the client is closed
+func TestClientFatalReadError(t *testing.T) {
+	a, b := Pipe()
+	defer b.Close()
+	conn := failConn{MemConn: a, fail: make(chan error, 1)}
+	c, err := NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h := make(eventHandler, 1)
+	if err := c.TransactionLaunch(MessageBuild(TransactionID, BindingRequest), h, time.Now().Add(time.Second*5)); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.fail <- io.ErrUnexpectedEOF
+	select {
+	case err := <-c.Errors():
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("err is %v, want %v", err, io.ErrUnexpectedEOF)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no error")
+	}
+	if e := h.next(t); e.Err != ErrAgent {
+		t.Fatalf("err of the pending transaction is %v, want %v", e.Err, ErrAgent)
+	}
+	if !c.isClosed() {
+		t.Fatal("client is not closed")
+	}
+}
+
+// the errors which nobody receives are dropped, the loops are not blocked
+func TestClientErrorsNotReceived(t *testing.T) {
+	c, _ := testClient(t)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < errorsBuffer*2; i++ {
+			c.closeOnError(io.ErrUnexpectedEOF)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("closeOnError is blocked")
+	}
+	if n := len(c.Errors()); n != errorsBuffer {
+		t.Fatalf("%d errors, want %d", n, errorsBuffer)
+	}
+}
+
+// wait until clk has only the ticker of d, e.g. after the loop replaced its ticker
+func waitTicker(t *testing.T, clk *FakeClock, d time.Duration) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second * 5); ; {
+		clk.mux.Lock()
+		ok := len(clk.tickers) == 1 && clk.tickers[0].d == d
+		clk.mux.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no ticker of %s", d)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// SetTimeoutRate replaces the ticker of the running timeout loop
+func TestClientSetTimeoutRate(t *testing.T) {
+	clk := NewFakeClock(time.Unix(1000, 0))
+	c, _ := testClient(t, WithClock(clk), WithMaxRetries(0))
+	if err := c.SetTimeoutRate(0); err == nil {
+		t.Fatal("no error of zero rate")
+	}
+	if err := c.SetTimeoutRate(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitTicker(t, clk, time.Second)
+
+	h := make(eventHandler, 1)
+	if err := c.TransactionLaunch(MessageBuild(TransactionID, BindingRequest), h, clk.Now().Add(time.Millisecond*500)); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(time.Millisecond * 600) // the deadline is passed, but not the tick
+	time.Sleep(time.Millisecond * 100)
+	h.none(t)
+	clk.Advance(time.Millisecond * 400)
+	if e := h.next(t); e.Err != TransactionTimeOutErr {
+		t.Fatalf("err is %v, want %v", e.Err, TransactionTimeOutErr)
+	}
+
+	c.Close()
+	if err := c.SetTimeoutRate(time.Second); err != ErrAgent {
+		t.Fatalf("err after Close is %v, want %v", err, ErrAgent)
+	}
+}
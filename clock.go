@@ -0,0 +1,151 @@
+package gostun
+
+import (
+	"sync"
+	"time"
+)
+
+// source of the time of transactions: deadlines, retransmissions and RTT.
+// the deadlines of conn are not affected, they are always real time
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// reference time.Ticker same work
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Clock of the time package, which is the default
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (r realTicker) C() <-chan time.Time {
+	return r.t.C
+}
+
+func (r realTicker) Stop() {
+	r.t.Stop()
+}
+
+// Clock for testing, the time is changed only by Advance.
+// the tickers are fired by Advance with the last passed tick, the older ticks are dropped
+type FakeClock struct {
+	mux     sync.Mutex // guards now and tickers
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.now
+}
+
+func (f *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	t := &fakeTicker{
+		clock: f,
+		c:     make(chan time.Time, 1),
+		d:     d,
+		next:  f.now.Add(d),
+	}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// move the time forward by d and fire the tickers which are passed
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.now = f.now.Add(d)
+	for _, t := range f.tickers {
+		if t.next.After(f.now) {
+			continue
+		}
+		var last time.Time
+		for !t.next.After(f.now) {
+			last = t.next
+			t.next = t.next.Add(t.d)
+		}
+		select {
+		case <-t.c: // not received yet, replaced by last
+		default:
+		}
+		t.c <- last
+	}
+}
+
+type fakeTicker struct {
+	clock *FakeClock
+	c     chan time.Time
+	d     time.Duration
+	next  time.Time // guarded by the mux of clock
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	f := t.clock
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	for i, ft := range f.tickers {
+		if ft == t {
+			f.tickers = append(f.tickers[:i], f.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+// the loops read c.clock without lock, so it is set before they are started
+func (c *Client) setClock(clk Clock) {
+	c.clock = clk
+	if a, ok := c.agent.(interface {
+		SetClock(Clock)
+	}); ok {
+		a.SetClock(clk)
+	}
+}
+
+// set clk as the Clock of a, nil is the real time
+func (a *Agent) SetClock(clk Clock) {
+	if clk == nil {
+		clk = realClock{}
+	}
+	a.mux.Lock()
+	a.clock = clk
+	a.mux.Unlock()
+}
+
+func (a *Agent) now() time.Time {
+	a.mux.RLock()
+	clk := a.clock
+	a.mux.RUnlock()
+	return clk.Now()
+}
@@ -0,0 +1,46 @@
+package gostun
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClientTimeOutFakeClock(t *testing.T) {
+	clk := NewFakeClock(time.Unix(1000, 0))
+	c, peer := testClient(t, WithClock(clk), WithMaxRetries(0), WithTimeoutRate(time.Millisecond*100))
+	h := make(eventHandler, 1)
+	if err := c.TransactionLaunch(MessageBuild(TransactionID, BindingRequest), h, clk.Now().Add(time.Second*2)); err != nil {
+		t.Fatal(err)
+	}
+	readRequest(t, peer)
+	clk.Advance(time.Second)
+	h.none(t)
+	clk.Advance(time.Second + time.Millisecond*100)
+	if e := h.next(t); e.Err != TransactionTimeOutErr {
+		t.Fatalf("err is %v, want %v", e.Err, TransactionTimeOutErr)
+	}
+}
+
+// 3 requests at 0, 1 and 3 s, the transaction fails 16 RTO after the last request
+func TestClientTimeOutRetransmitFakeClock(t *testing.T) {
+	clk := NewFakeClock(time.Unix(1000, 0))
+	c, peer := testClient(t, WithClock(clk), WithRTO(time.Second), WithMaxRetries(3), WithTimeoutRate(time.Millisecond*100))
+	h := make(eventHandler, 1)
+	if err := c.TransactionLaunch(MessageBuild(TransactionID, BindingRequest), h, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	req := readRequest(t, peer)
+	for i := 0; i < 2; i++ {
+		clk.Advance(time.Second*time.Duration(1<<uint(i)) + time.Millisecond*100)
+		if m := readRequest(t, peer); m.TransactionID != req.TransactionID {
+			t.Fatalf("retransmission %d has id %x, want %x", i, m.TransactionID, req.TransactionID)
+		}
+		h.none(t)
+	}
+	clk.Advance(time.Second * 15)
+	h.none(t)
+	clk.Advance(time.Second + time.Millisecond*100)
+	if e := h.next(t); e.Err != TransactionTimeOutErr {
+		t.Fatalf("err is %v, want %v", e.Err, TransactionTimeOutErr)
+	}
+}
@@ -0,0 +1,139 @@
+package gostun
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+/*
+   USERNAME: It MUST contain a UTF-8 encoded sequence of less than 513 bytes.
+   REALM:    It MUST be a UTF-8 encoded sequence of less than 128 characters
+             (which can be as long as 763 bytes).
+   NONCE:    It MUST be less than 128 characters (which can be as long as 763 bytes).
+*/
+
+const (
+	maxUsername = 512 // less than 513 bytes
+	maxRealm    = 763
+	maxNonce    = 763
+)
+
+type Username string
+
+type Realm string
+
+type Nonce []byte
+
+// add UTF-8 text attribute which is less than max bytes
+func addText(m *Message, t AttributeType, v []byte, max int) error {
+	if len(v) > max {
+		err := fmt.Sprintf("%s length(%d) is more than %d", t, len(v), max)
+		return errors.New(err)
+	}
+	if !utf8.Valid(v) {
+		err := fmt.Sprintf("%s is not valid UTF-8", t)
+		return errors.New(err)
+	}
+	return m.Add(t, v)
+}
+
+func getText(m *Message, t AttributeType, max int) ([]byte, error) {
+	v, err := m.GetRapped(t)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) > max {
+		err := fmt.Sprintf("%s length(%d) is more than %d", t, len(v), max)
+		return nil, errors.New(err)
+	}
+	if !utf8.Valid(v) {
+		err := fmt.Sprintf("%s is not valid UTF-8", t)
+		return nil, errors.New(err)
+	}
+	return v, nil
+}
+
+func (u Username) AddTo(m *Message) error {
+	return addText(m, USERNAME, []byte(u), maxUsername)
+}
+
+func (u *Username) GetFrom(m *Message) error {
+	v, err := getText(m, USERNAME, maxUsername)
+	if err != nil {
+		return err
+	}
+	*u = Username(v)
+	return nil
+}
+
+func (r Realm) AddTo(m *Message) error {
+	return addText(m, REALM, []byte(r), maxRealm)
+}
+
+func (r *Realm) GetFrom(m *Message) error {
+	v, err := getText(m, REALM, maxRealm)
+	if err != nil {
+		return err
+	}
+	*r = Realm(v)
+	return nil
+}
+
+func (n Nonce) AddTo(m *Message) error {
+	if len(n) > maxNonce {
+		err := fmt.Sprintf("NONCE length(%d) is more than %d", len(n), maxNonce)
+		return errors.New(err)
+	}
+	return m.Add(NONCE, n)
+}
+
+func (n *Nonce) GetFrom(m *Message) error {
+	v, err := m.GetRapped(NONCE)
+	if err != nil {
+		return err
+	}
+	if len(v) > maxNonce {
+		err := fmt.Sprintf("NONCE length(%d) is more than %d", len(v), maxNonce)
+		return errors.New(err)
+	}
+	*n = append((*n)[:0], v...)
+	return nil
+}
+
+/*
+   USERHASH: RFC 8489 section 14.4
+   userhash = SHA-256(OpaqueString(username) ":" OpaqueString(realm))
+   It is sent instead of USERNAME, when the server offers username anonymity.
+*/
+
+const userHashSize = 32 // SHA-256
+
+type UserHash []byte
+
+func NewUserHash(username, realm string) UserHash {
+	h := sha256.Sum256([]byte(username + ":" + realm))
+	return UserHash(h[:])
+}
+
+func (u UserHash) AddTo(m *Message) error {
+	if len(u) != userHashSize {
+		err := fmt.Sprintf("USERHASH length(%d) is not %d", len(u), userHashSize)
+		return errors.New(err)
+	}
+	return m.Add(USERHASH, u)
+}
+
+func (u *UserHash) GetFrom(m *Message) error {
+	v, err := m.GetRapped(USERHASH)
+	if err != nil {
+		return err
+	}
+	if len(v) != userHashSize {
+		err := fmt.Sprintf("USERHASH length(%d) is not %d", len(v), userHashSize)
+		return errors.New(err)
+	}
+	*u = append((*u)[:0], v...)
+	return nil
+}
@@ -0,0 +1,30 @@
+package gostun
+
+import (
+	"strings"
+	"testing"
+)
+
+// USERNAME is less than 513 bytes
+func TestUsernameLength(t *testing.T) {
+	for _, tc := range []struct {
+		n  int
+		ok bool
+	}{
+		{512, true},
+		{513, false},
+	} {
+		u := Username(strings.Repeat("u", tc.n))
+		m := MessageBuild(TransactionID, BindingRequest)
+		if err := u.AddTo(m); (err == nil) != tc.ok {
+			t.Fatalf("AddTo of %d bytes: %v", tc.n, err)
+		}
+
+		m = MessageBuild(TransactionID, BindingRequest)
+		m.Add(USERNAME, []byte(u))
+		var got Username
+		if err := got.GetFrom(m); (err == nil) != tc.ok {
+			t.Fatalf("GetFrom of %d bytes: %v", tc.n, err)
+		}
+	}
+}
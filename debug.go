@@ -0,0 +1,127 @@
+package gostun
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var methodName = map[Method]string{
+	MethodBinding:          "Binding",
+	MethodAllocate:         "Allocate",
+	MethodRefresh:          "Refresh",
+	MethodSend:             "Send",
+	MethodData:             "Data",
+	MethodCreatePermission: "CreatePermission",
+	MethodChannelBind:      "ChannelBind",
+}
+
+func (m Method) String() string {
+	if s, ok := methodName[m]; ok {
+		return s
+	}
+	return fmt.Sprintf("0x%03x", uint16(m))
+}
+
+var className = map[MessageClass]string{
+	ClassRequest:         "request",
+	ClassIndication:      "indication",
+	ClassSuccessResponse: "success response",
+	ClassErrorResponse:   "error response",
+}
+
+func (c MessageClass) String() string {
+	if s, ok := className[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("class(%d)", byte(c))
+}
+
+func (t MessageType) String() string {
+	return fmt.Sprintf("%s %s", t.Method, t.Class)
+}
+
+// e.g. "Binding success response id=0102030405060708090a0b0c len=12 [XOR-MAPPED-ADDRESS: 192.0.2.1:3478]"
+func (m *Message) String() string {
+	attrs := make([]string, len(m.Attributes))
+	for i, a := range m.Attributes {
+		attrs[i] = fmt.Sprintf("%s: %s", a.Type, m.summary(a))
+	}
+	return fmt.Sprintf("%s id=%x len=%d [%s]",
+		m.Type, m.TransactionID, m.Length, strings.Join(attrs, ", "),
+	)
+}
+
+// decoded value of a, the raw value in hex if it is not decoded
+func (m *Message) summary(a AttributeField) string {
+	// a may be repeated, so decode it alone with the transaction id of m
+	one := &Message{
+		TransactionID: m.TransactionID,
+		Attributes:    Attributes{a},
+	}
+	switch a.Type {
+	case MAPPED_ADDRESS, RESPONSE_ADDRESS, SOURCE_ADDRESS, CHANGED_ADDRESS, ALTERNATE_SERVER, RESPONSE_ORIGIN, OTHER_ADDRESS:
+		var addr Addr
+		if addr.decodeAddr(one, a.Type) == nil {
+			return net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
+		}
+	case XOR_MAPPED_ADDRESS, XOR_MAPPED_ADDRESS_LEGACY, XOR_PEER_ADDRESS, XOR_RELAYED_ADDRESS:
+		var addr xorAddr
+		if addr.decode(one, a.Type) == nil {
+			return net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
+		}
+	case SOFTWARE, USERNAME, REALM, NONCE:
+		return strconv.Quote(string(a.Value))
+	case ERROR_CODE:
+		var e ErrorCodeAttribute
+		if e.GetFrom(one) == nil {
+			return fmt.Sprintf("%d %s", e.Code, e.Reason)
+		}
+	}
+	return fmt.Sprintf("0x%x", a.Value)
+}
+
+// snapshot of the registered transaction, see Agent.Pending
+type TransactionInfo struct {
+	ID       string      // transaction id in hex
+	Type     MessageType // type of the request, zero if it is not set
+	Deadline time.Time   // zero if the transaction is not timed out
+	Age      time.Duration
+}
+
+// the registered transactions, the oldest first.
+// each shard is locked only while it is copied
+func (a *Agent) Pending() []TransactionInfo {
+	now := a.now()
+	var infos []TransactionInfo
+	for _, s := range a.shards {
+		s.mux.Lock()
+		for id, tr := range s.transactions {
+			infos = append(infos, TransactionInfo{
+				ID:       hex.EncodeToString(id[:]),
+				Type:     tr.Type,
+				Deadline: tr.Timeout,
+				Age:      now.Sub(tr.Start),
+			})
+		}
+		s.mux.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Age > infos[j].Age
+	})
+	return infos
+}
+
+// the transactions in flight of c, nil if the agent does not support it
+func (c *Client) Pending() []TransactionInfo {
+	if a, ok := c.agent.(interface {
+		Pending() []TransactionInfo
+	}); ok {
+		return a.Pending()
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package gostun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+   Public STUN servers are often down or rate-limited, so the reflexive
+   address is discovered by any working server of the list.
+   DiscoverMulti tries them in turn, and DiscoverFastest tries them at once.
+*/
+
+// public address which is seen by the server of addr, the request is timed out at deadline
+func discoverBefore(addr string, deadline time.Time) (net.Addr, error) {
+	c, err := Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	return c.Bind(deadline)
+}
+
+// errors of all servers in the order of addrs
+func discoverError(addrs []string, errs []error) error {
+	if len(addrs) == 0 {
+		return errors.New("no STUN server address")
+	}
+	s := make([]string, len(addrs))
+	for i, addr := range addrs {
+		s[i] = fmt.Sprintf("%s: %s", addr, errs[i])
+	}
+	err := fmt.Sprintf("all STUN servers failed: %s", strings.Join(s, "; "))
+	return errors.New(err)
+}
+
+// try the servers of addrs in turn until one returns the public address,
+// the error of each server is returned if all of them failed.
+// the rest of the time is shared by the rest of the servers, so a down server does not use all of it
+func DiscoverMulti(addrs []string, deadline time.Time) (net.Addr, error) {
+	errs := make([]error, len(addrs))
+	for i, addr := range addrs {
+		now := time.Now()
+		if !now.Before(deadline) {
+			errs[i] = TransactionTimeOutErr // not tried
+			continue
+		}
+		d := now.Add(deadline.Sub(now) / time.Duration(len(addrs)-i))
+		a, err := discoverBefore(addr, d)
+		if err == nil {
+			return a, nil
+		}
+		errs[i] = err
+	}
+	return nil, discoverError(addrs, errs)
+}
+
+// try the servers of addrs at once, and returns the first public address.
+// the others are closed when they are done
+func DiscoverFastest(addrs []string, deadline time.Time) (net.Addr, error) {
+	type result struct {
+		i    int
+		addr net.Addr
+		err  error
+	}
+	results := make(chan result, len(addrs)) // the rest are not received after the first success
+	for i, addr := range addrs {
+		go func(i int, addr string) {
+			a, err := discoverBefore(addr, deadline)
+			results <- result{i: i, addr: a, err: err}
+		}(i, addr)
+	}
+
+	errs := make([]error, len(addrs))
+	for range addrs {
+		r := <-results
+		if r.err == nil {
+			return r.addr, nil
+		}
+		errs[r.i] = r.err
+	}
+	return nil, discoverError(addrs, errs)
+}
@@ -0,0 +1,179 @@
+package gostun
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |           Reserved, should be 0         |Class|     Number    |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |      Reason Phrase (variable)                                ..
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+                      ERROR-CODE Attribute
+*/
+
+// error code: page 39
+const (
+	CodeTryAlternate     = 300
+	CodeBadRequest       = 400
+	CodeUnauthorized     = 401
+	CodeUnknownAttribute = 420
+	CodeStaleNonce       = 438
+	CodeServerError      = 500
+
+	// TURN: RFC 5766 page 44, RFC 6062 for TCP
+	CodeAllocationMismatch   = 437
+	CodeUnsupportedTransport = 442
+
+	// ICE: RFC 5245 page 88
+	CodeRoleConflict = 487
+)
+
+var ErrorReason = map[int]string{
+	CodeTryAlternate:     "Try Alternate",
+	CodeBadRequest:       "Bad Request",
+	CodeUnauthorized:     "Unauthorized",
+	CodeUnknownAttribute: "Unknown Attribute",
+	CodeStaleNonce:       "Stale Nonce",
+	CodeServerError:      "Server Error",
+
+	CodeAllocationMismatch:   "Allocation Mismatch",
+	CodeUnsupportedTransport: "Unsupported Transport Protocol",
+
+	CodeRoleConflict: "Role Conflict",
+}
+
+const (
+	errorCodeHeader    = 4
+	errorCodeModulo    = 100
+	maxReasonPhrase    = 763 // less than 128 characters
+	minErrorCode       = 300
+	maxErrorCode       = 699
+	errorCodeClassByte = 2
+	errorCodeNumByte   = 3
+)
+
+type ErrorCodeAttribute struct {
+	Code   int
+	Reason string
+}
+
+// the error response of server
+func (e ErrorCodeAttribute) Error() string {
+	return fmt.Sprintf("error response %d: %s", e.Code, e.Reason)
+}
+
+func (e *ErrorCodeAttribute) AddTo(m *Message) error {
+	if e.Code < minErrorCode || e.Code > maxErrorCode {
+		err := fmt.Sprintf("error code %d is out of range %d-%d", e.Code, minErrorCode, maxErrorCode)
+		return errors.New(err)
+	}
+	if len(e.Reason) > maxReasonPhrase {
+		err := fmt.Sprintf("reason phrase(%d) is more than %d", len(e.Reason), maxReasonPhrase)
+		return errors.New(err)
+	}
+
+	v := make([]byte, errorCodeHeader, errorCodeHeader+len(e.Reason))
+	v[errorCodeClassByte] = byte(e.Code / errorCodeModulo)
+	v[errorCodeNumByte] = byte(e.Code % errorCodeModulo)
+	v = append(v, e.Reason...)
+
+	return m.Add(ERROR_CODE, v)
+}
+
+func (e *ErrorCodeAttribute) GetFrom(m *Message) error {
+	v, err := m.GetRapped(ERROR_CODE)
+	if err != nil {
+		return err
+	}
+	if len(v) < errorCodeHeader {
+		err := fmt.Sprintf("ERROR-CODE length(%d) is less than %d", len(v), errorCodeHeader)
+		return errors.New(err)
+	}
+
+	cn, err := getU16(v, errorCodeClassByte) // class and number
+	if err != nil {
+		return err
+	}
+	class := int(cn>>8) & 0x7 // 3 bits
+	number := int(cn & 0xff)
+	e.Code = class*errorCodeModulo + number
+	e.Reason = string(v[errorCodeHeader:])
+
+	return nil
+}
+
+// error response of the server, which is returned by the client.
+// Msg is the response, e.g. for REALM and NONCE of 401
+type StunError struct {
+	Code   int
+	Reason string
+	Msg    *Message
+}
+
+func (e *StunError) Error() string {
+	return fmt.Sprintf("error response %d: %s", e.Code, e.Reason)
+}
+
+// returns the ERROR-CODE of error response m as *StunError, nil if m is not error response
+func responseError(m *Message) error {
+	if !m.IsErrorResponse() {
+		return nil
+	}
+	var e ErrorCodeAttribute
+	if err := e.GetFrom(m); err != nil {
+		return errors.New("error response without valid ERROR-CODE")
+	}
+	return &StunError{
+		Code:   e.Code,
+		Reason: e.Reason,
+		Msg:    m,
+	}
+}
+
+// err is the error response of code
+func isErrorCode(err error, code int) bool {
+	var e *StunError
+	return errors.As(err, &e) && e.Code == code
+}
+
+func IsTryAlternate(err error) bool {
+	return isErrorCode(err, CodeTryAlternate)
+}
+
+func IsBadRequest(err error) bool {
+	return isErrorCode(err, CodeBadRequest)
+}
+
+func IsUnauthorized(err error) bool {
+	return isErrorCode(err, CodeUnauthorized)
+}
+
+func IsUnknownAttribute(err error) bool {
+	return isErrorCode(err, CodeUnknownAttribute)
+}
+
+func IsStaleNonce(err error) bool {
+	return isErrorCode(err, CodeStaleNonce)
+}
+
+func IsServerError(err error) bool {
+	return isErrorCode(err, CodeServerError)
+}
+
+func IsRoleConflict(err error) bool {
+	return isErrorCode(err, CodeRoleConflict)
+}
+
+func IsAllocationMismatch(err error) bool {
+	return isErrorCode(err, CodeAllocationMismatch)
+}
+
+func IsUnsupportedTransport(err error) bool {
+	return isErrorCode(err, CodeUnsupportedTransport)
+}
@@ -0,0 +1,87 @@
+package gostun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+   The FINGERPRINT attribute MAY be present in all STUN messages.  The
+   value of the attribute is computed as the CRC-32 of the STUN message
+   up to (but excluding) the FINGERPRINT attribute itself, XOR'ed with
+   the 32-bit value 0x5354554e.  When present, the FINGERPRINT attribute
+   MUST be the last attribute in the message, and thus will appear after
+   MESSAGE-INTEGRITY.
+*/
+
+const (
+	fingerprintXOR  = 0x5354554e
+	fingerprintSize = 4 // CRC-32
+)
+
+var (
+	ErrFingerprintMismatch       = errors.New("fingerprint mismatch")
+	ErrAttributeAfterFingerprint = errors.New("attribute after FINGERPRINT")
+	ErrFingerprintRequired       = errors.New("message without FINGERPRINT")
+)
+
+type Fingerprint struct{}
+
+var FingerprintAttr = Fingerprint{}
+
+func fingerprintValue(b []byte) uint32 {
+	return crc32.ChecksumIEEE(b) ^ fingerprintXOR
+}
+
+// add FINGERPRINT to m, it must be the last attribute
+func (Fingerprint) AddTo(m *Message) error {
+	if len(m.Raw) < messageHeader {
+		m.Encode()
+	}
+
+	// length field includes FINGERPRINT while computing CRC-32, Add writes it again.
+	// if Add fails, the length of m.Length is restored
+	m.WriteLengthIncluding(attributeHeader + fingerprintSize)
+	defer m.WriteMessageLength()
+	v := make([]byte, fingerprintSize)
+	binary.BigEndian.PutUint32(v, fingerprintValue(m.Raw))
+
+	return m.Add(FINGERPRINT, v)
+}
+
+// verify FINGERPRINT of m
+func (Fingerprint) Check(m *Message) error {
+	v, err := m.GetRapped(FINGERPRINT)
+	if err != nil {
+		return err
+	}
+	if len(v) != fingerprintSize {
+		err := fmt.Sprintf("FINGERPRINT length(%d) is not %d", len(v), fingerprintSize)
+		return errors.New(err)
+	}
+	if !m.hasFingerprint() {
+		return errors.New("FINGERPRINT is not the last attribute")
+	}
+
+	// FINGERPRINT is the last attribute, so the length field already includes it and m.Raw is read as is
+	offset := len(m.Raw) - attributeHeader - fingerprintSize
+	if offset < messageHeader {
+		return errors.New("m.Raw is shorter than FINGERPRINT")
+	}
+	crc, err := getU32(v, 0)
+	if err != nil {
+		return err
+	}
+	if crc != fingerprintValue(m.Raw[:offset]) {
+		return ErrFingerprintMismatch
+	}
+	return nil
+}
+
+// last attribute of m is FINGERPRINT
+func (m *Message) hasFingerprint() bool {
+	l := len(m.Attributes)
+	return l > 0 && m.Attributes[l-1].Type == FINGERPRINT
+}
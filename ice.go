@@ -0,0 +1,125 @@
+package gostun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+   PRIORITY: 32-bit unsigned integer, the priority of the peer reflexive
+   candidate which would be learned by the connectivity check.
+
+   USE-CANDIDATE: it has no content, the Length field is zero.  The
+   controlling agent adds it to nominate the candidate pair.
+
+   ICE-CONTROLLING and ICE-CONTROLLED: 64-bit unsigned integer, the
+   tie-breaker which resolves the role conflict.  If both agents claim the
+   same role, the server side responds 487 (Role Conflict) and the client
+   switches its role.
+
+   These are sent on Binding requests with USERNAME and MESSAGE-INTEGRITY
+   of the short-term credential, so add them before MESSAGE-INTEGRITY.
+*/
+
+const prioritySize = 4
+
+type Priority uint32
+
+func (p Priority) AddTo(m *Message) error {
+	v := make([]byte, prioritySize)
+	binary.BigEndian.PutUint32(v, uint32(p))
+	return m.Add(PRIORITY, v)
+}
+
+func (p *Priority) GetFrom(m *Message) error {
+	v, err := m.GetRapped(PRIORITY)
+	if err != nil {
+		return err
+	}
+	if len(v) != prioritySize {
+		err := fmt.Sprintf("PRIORITY length(%d) is not %d", len(v), prioritySize)
+		return errors.New(err)
+	}
+	priority, err := getU32(v, 0)
+	if err != nil {
+		return err
+	}
+	*p = Priority(priority)
+	return nil
+}
+
+type UseCandidate struct{}
+
+var UseCandidateAttr = UseCandidate{}
+
+func (UseCandidate) AddTo(m *Message) error {
+	return m.Add(USE_CANDIDATE, nil)
+}
+
+// m has USE-CANDIDATE
+func (UseCandidate) IsSet(m *Message) bool {
+	_, ok := m.Get(USE_CANDIDATE)
+	return ok
+}
+
+const tieBreakerSize = 8
+
+type IceControlling uint64
+
+type IceControlled uint64
+
+// returns random tie-breaker read from crypto/rand
+func NewTieBreaker() (uint64, error) {
+	var b [tieBreakerSize]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+func addTieBreaker(m *Message, t AttributeType, tb uint64) error {
+	v := make([]byte, tieBreakerSize)
+	binary.BigEndian.PutUint64(v, tb)
+	return m.Add(t, v)
+}
+
+func getTieBreaker(m *Message, t AttributeType) (uint64, error) {
+	v, err := m.GetRapped(t)
+	if err != nil {
+		return 0, err
+	}
+	if len(v) != tieBreakerSize {
+		err := fmt.Sprintf("%s length(%d) is not %d", t, len(v), tieBreakerSize)
+		return 0, errors.New(err)
+	}
+	return getU64(v, 0)
+}
+
+func (c IceControlling) AddTo(m *Message) error {
+	return addTieBreaker(m, ICE_CONTROLLING, uint64(c))
+}
+
+func (c *IceControlling) GetFrom(m *Message) error {
+	tb, err := getTieBreaker(m, ICE_CONTROLLING)
+	if err != nil {
+		return err
+	}
+	*c = IceControlling(tb)
+	return nil
+}
+
+func (c IceControlled) AddTo(m *Message) error {
+	return addTieBreaker(m, ICE_CONTROLLED, uint64(c))
+}
+
+func (c *IceControlled) GetFrom(m *Message) error {
+	tb, err := getTieBreaker(m, ICE_CONTROLLED)
+	if err != nil {
+		return err
+	}
+	*c = IceControlled(tb)
+	return nil
+}
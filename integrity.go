@@ -0,0 +1,137 @@
+package gostun
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+   The MESSAGE-INTEGRITY attribute contains an HMAC-SHA1 of the STUN message.
+   The text used as input to HMAC is the STUN message, including the header,
+   up to and including the attribute preceding the MESSAGE-INTEGRITY attribute.
+   With the exception of the FINGERPRINT attribute, which appears after
+   MESSAGE-INTEGRITY, agents MUST ignore all other attributes that follow
+   MESSAGE-INTEGRITY.
+
+   The length MUST then be set to point to the length of the message up to,
+   and including, the MESSAGE-INTEGRITY attribute itself, but excluding any
+   attributes after it.
+
+   For long-term credentials:  key = MD5(username ":" realm ":" SASLprep(password))
+   For short-term credentials: key = SASLprep(password)
+*/
+
+const messageIntegritySize = 20 // HMAC-SHA1
+
+var (
+	ErrIntegrityMismatch       = errors.New("message integrity mismatch")
+	ErrAttributeAfterIntegrity = errors.New("attribute other than FINGERPRINT after MESSAGE-INTEGRITY")
+)
+
+// key of HMAC-SHA1
+type MessageIntegrity []byte
+
+func NewShortTermIntegrity(password string) MessageIntegrity {
+	return MessageIntegrity(password)
+}
+
+// key of MD5, which is used unless PASSWORD-ALGORITHM is selected
+func NewLongTermIntegrity(username, realm, password string) MessageIntegrity {
+	k, _ := PasswordAlgorithmMD5.key(username, realm, password)
+	return MessageIntegrity(k)
+}
+
+// key of alg selected by PASSWORD-ALGORITHM
+func NewLongTermIntegrityAlgorithm(alg PasswordAlgorithm, username, realm, password string) (MessageIntegrity, error) {
+	k, err := alg.key(username, realm, password)
+	if err != nil {
+		return nil, err
+	}
+	return MessageIntegrity(k), nil
+}
+
+func newHMAC(key, message []byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// compute HMAC of m.Raw and add MESSAGE-INTEGRITY to m
+func (i MessageIntegrity) AddTo(m *Message) error {
+	return addIntegrity(m, MESSAGE_INTEGRITY, messageIntegritySize, func(b []byte) []byte {
+		return newHMAC(i, b)
+	})
+}
+
+// verify MESSAGE-INTEGRITY of m with i
+func (i MessageIntegrity) Check(m *Message) error {
+	v, err := m.GetRapped(MESSAGE_INTEGRITY)
+	if err != nil {
+		return err
+	}
+	if len(v) != messageIntegritySize {
+		err := fmt.Sprintf("MESSAGE-INTEGRITY length(%d) is not %d", len(v), messageIntegritySize)
+		return errors.New(err)
+	}
+	return checkIntegrity(m, MESSAGE_INTEGRITY, v, func(b []byte) []byte {
+		return newHMAC(i, b)
+	})
+}
+
+// add the integrity attribute t of size to m, mac is the HMAC of the message
+func addIntegrity(m *Message, t AttributeType, size int, mac func([]byte) []byte) error {
+	if len(m.Raw) < messageHeader {
+		m.Encode()
+	}
+
+	// length field includes the attribute while computing HMAC, Add writes it again.
+	// if Add fails, the length of m.Length is restored
+	m.WriteLengthIncluding(attributeHeader + size)
+	defer m.WriteMessageLength()
+	v := mac(m.Raw)[:size]
+
+	return m.Add(t, v)
+}
+
+// offset of the first attribute t in m.Raw. the headers of m.Raw are walked,
+// since the ignored attributes after MESSAGE-INTEGRITY are not in m.Attributes
+func rawOffset(m *Message, t AttributeType) (int, bool) {
+	offset := messageHeader
+	for {
+		typ, err := getU16(m.Raw, offset)
+		if err != nil {
+			return 0, false
+		}
+		if AttributeType(typ) == t {
+			return offset, true
+		}
+		length, err := getU16(m.Raw, offset+2)
+		if err != nil {
+			return 0, false
+		}
+		offset += attributeHeader + paddingLength(int(length))
+	}
+}
+
+// compare v of the integrity attribute t with the HMAC of m truncated to len(v)
+func checkIntegrity(m *Message, t AttributeType, v []byte, mac func([]byte) []byte) error {
+	offset, ok := rawOffset(m, t)
+	if !ok {
+		return errors.New("m.Raw is shorter than the attributes")
+	}
+
+	// length field ends at the attribute, the attributes after it are excluded.
+	// it is written to a copy, m.Raw is not changed by the check, e.g. of concurrent readers
+	b := make([]byte, offset)
+	copy(b, m.Raw)
+	binary.BigEndian.PutUint16(b[2:4], uint16(offset-messageHeader+attributeHeader+len(v)))
+	expected := mac(b)[:len(v)]
+
+	if !hmac.Equal(v, expected) {
+		return ErrIntegrityMismatch
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package gostun
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+/*
+   MESSAGE-INTEGRITY-SHA256: RFC 8489 section 14.6
+   The HMAC-SHA256 of the message, computed same as MESSAGE-INTEGRITY.
+   It may be truncated to 16 bytes at least, in a multiple of 4 bytes.
+   MESSAGE-INTEGRITY may precede it, and only FINGERPRINT may follow it.
+*/
+
+const (
+	messageIntegritySHA256Size = 32 // HMAC-SHA256
+	minIntegritySHA256Size     = 16
+)
+
+// key of HMAC-SHA256 and the length of the truncated value
+type MessageIntegritySHA256 struct {
+	Key    []byte
+	Length int // 16-32 bytes in a multiple of 4, 0 is not truncated
+}
+
+func NewShortTermIntegritySHA256(password string) MessageIntegritySHA256 {
+	return MessageIntegritySHA256{Key: []byte(password)}
+}
+
+// key is MD5 same as MESSAGE-INTEGRITY, unless PASSWORD-ALGORITHM is selected
+func NewLongTermIntegritySHA256(username, realm, password string) MessageIntegritySHA256 {
+	return MessageIntegritySHA256{Key: NewLongTermIntegrity(username, realm, password)}
+}
+
+func newHMACSHA256(key, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+func checkIntegritySHA256Size(l int) error {
+	if l < minIntegritySHA256Size || l > messageIntegritySHA256Size || l%4 != 0 {
+		err := fmt.Sprintf("MESSAGE-INTEGRITY-SHA256 length(%d) is not a multiple of 4 in %d-%d",
+			l, minIntegritySHA256Size, messageIntegritySHA256Size)
+		return errors.New(err)
+	}
+	return nil
+}
+
+// compute HMAC of m.Raw and add MESSAGE-INTEGRITY-SHA256 to m
+func (i MessageIntegritySHA256) AddTo(m *Message) error {
+	size := i.Length
+	if size == 0 {
+		size = messageIntegritySHA256Size
+	}
+	if err := checkIntegritySHA256Size(size); err != nil {
+		return err
+	}
+	return addIntegrity(m, MESSAGE_INTEGRITY_SHA256, size, func(b []byte) []byte {
+		return newHMACSHA256(i.Key, b)
+	})
+}
+
+// verify MESSAGE-INTEGRITY-SHA256 of m with i, the value of any valid length is accepted
+func (i MessageIntegritySHA256) Check(m *Message) error {
+	v, err := m.GetRapped(MESSAGE_INTEGRITY_SHA256)
+	if err != nil {
+		return err
+	}
+	if err := checkIntegritySHA256Size(len(v)); err != nil {
+		return err
+	}
+	return checkIntegrity(m, MESSAGE_INTEGRITY_SHA256, v, func(b []byte) []byte {
+		return newHMACSHA256(i.Key, b)
+	})
+}
+
+// m has MESSAGE-INTEGRITY or MESSAGE-INTEGRITY-SHA256
+func (m *Message) hasIntegrity() bool {
+	for _, a := range m.Attributes {
+		if a.Type == MESSAGE_INTEGRITY || a.Type == MESSAGE_INTEGRITY_SHA256 {
+			return true
+		}
+	}
+	return false
+}
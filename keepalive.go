@@ -0,0 +1,71 @@
+package gostun
+
+import (
+	"time"
+)
+
+/*
+   NAT bindings are commonly removed after 30 seconds of idle, and the
+   TURN allocation is removed when its lifetime is passed.  The keepalive
+   is a Binding indication (RFC 5389 section 7.3.2), which has no response,
+   so no transaction is registered.  With KeepAliveRefresh the allocation
+   is refreshed instead, which also keeps the NAT binding.
+*/
+
+const (
+	defaultKeepAliveInterval = time.Second * 15
+
+	// lifetime requested by the Refresh of the keepalive, default of RFC 5766
+	keepAliveLifetime = time.Minute * 10
+)
+
+// send the keepalive every interval until Close, 0 is the default of 15 seconds
+func (c *Client) StartKeepAlive(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultKeepAliveInterval
+	}
+	// Close waits c.wg after closed is set, so the goroutine is not added after it
+	c.rw.Lock()
+	defer c.rw.Unlock()
+	if c.closed {
+		return
+	}
+	c.wg.Add(1)
+	go c.keepAliveUntil(c.clock.NewTicker(interval))
+}
+
+func (c *Client) keepAliveUntil(t Ticker) {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-c.close:
+			t.Stop()
+			return
+		case <-t.C():
+			err := c.keepAlive()
+			if err == ErrAgent || c.isClosed() {
+				t.Stop()
+				return
+			}
+			if err != nil {
+				c.logEvent(LogEvent{Kind: LogKeepAliveError, Err: err}) // next keepalive may succeed
+			}
+		}
+	}
+}
+
+func (c *Client) keepAlive() error {
+	c.rw.RLock()
+	alloc := c.alloc
+	c.rw.RUnlock()
+	if c.KeepAliveRefresh && alloc != nil {
+		_, err := c.refresh(keepAliveLifetime)
+		return err
+	}
+
+	m := new(Message)
+	if err := m.Build(TransactionID, BindingIndication); err != nil {
+		return err
+	}
+	return c.indicate(m)
+}
@@ -0,0 +1,138 @@
+package gostun
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+type LogKind int
+
+const (
+	LogRequestSent LogKind = iota
+	LogRetransmitScheduled
+	LogResponseReceived
+	LogTransactionTimeout
+	LogDecodeError
+	LogLoopError
+	LogOversize
+	LogReadError
+	LogWriteError
+	LogHandleError
+	LogKeepAliveError
+	LogEncodeError
+	LogResponseSent
+)
+
+var logKindName = map[LogKind]string{
+	LogRequestSent:         "request sent",
+	LogRetransmitScheduled: "retransmission scheduled",
+	LogResponseReceived:    "response received",
+	LogTransactionTimeout:  "transaction timed out",
+	LogDecodeError:         "decode error",
+	LogLoopError:           "loop stopped",
+	LogOversize:            "message exceeds MTU",
+	LogReadError:           "read error",
+	LogWriteError:          "write error",
+	LogHandleError:         "handle error",
+	LogKeepAliveError:      "keepalive failed",
+	LogEncodeError:         "encode error",
+	LogResponseSent:        "response sent",
+}
+
+func (k LogKind) String() string {
+	if s, ok := logKindName[k]; ok {
+		return s
+	}
+	return fmt.Sprintf("LogKind(%d)", int(k))
+}
+
+// event of the client for Logger, fields which are not related to Kind are zero
+type LogEvent struct {
+	Kind LogKind
+	ID   [TransactionIDSize]byte
+	Type MessageType   // request sent, response received, response sent
+	From net.Addr      // response received, decode error, write error of the server
+	RTO  time.Duration // retransmission scheduled
+	Err  error         // the errors, loop stopped, message exceeds MTU
+	Size int           // message exceeds MTU
+}
+
+// reference Handler same work, LogEvent must not block the loops of the client
+type Logger interface {
+	LogEvent(e LogEvent)
+}
+
+// set l as the Logger of c and its agent, nil logs only the errors to the log package
+func (c *Client) SetLogger(l Logger) {
+	c.rw.Lock()
+	c.logger = l
+	c.rw.Unlock()
+
+	if a, ok := c.agent.(interface {
+		SetLogger(Logger)
+	}); ok {
+		a.SetLogger(l)
+	}
+}
+
+func (c *Client) logEvent(e LogEvent) {
+	c.rw.RLock()
+	l := c.logger
+	c.rw.RUnlock()
+
+	if l != nil {
+		l.LogEvent(e)
+		return
+	}
+	logDefault(e)
+}
+
+// logs the errors to the log package, when no Logger is set
+func logDefault(e LogEvent) {
+	switch e.Kind {
+	case LogDecodeError:
+		// other protocol may share the socket, so ErrNotSTUN is not logged by default
+		if e.Err != ErrNotSTUN {
+			log.Print(e.Err)
+		}
+	case LogLoopError, LogOversize, LogReadError, LogWriteError, LogHandleError, LogKeepAliveError, LogEncodeError:
+		log.Print(e.Err)
+	}
+}
+
+// set l as the Logger of s, nil logs the errors to the log package
+func (s *Server) SetLogger(l Logger) {
+	s.mux.Lock()
+	s.logger = l
+	s.mux.Unlock()
+}
+
+func (s *Server) logEvent(e LogEvent) {
+	s.mux.RLock()
+	l := s.logger
+	s.mux.RUnlock()
+
+	if l != nil {
+		l.LogEvent(e)
+		return
+	}
+	logDefault(e)
+}
+
+// timed out transactions are logged by the agent, since the client does not know them
+func (a *Agent) SetLogger(l Logger) {
+	a.mux.Lock()
+	a.logger = l
+	a.mux.Unlock()
+}
+
+func (c *Client) logResponse(m *Message, from net.Addr) {
+	c.logEvent(LogEvent{
+		Kind: LogResponseReceived,
+		ID:   m.TransactionID,
+		Type: m.Type,
+		From: from,
+	})
+}
@@ -0,0 +1,74 @@
+package gostun
+
+import (
+	"testing"
+	"time"
+)
+
+// Logger which records the events
+type eventLogger chan LogEvent
+
+func (l eventLogger) LogEvent(e LogEvent) {
+	select {
+	case l <- e:
+	default: // the test doesn't wait for it
+	}
+}
+
+// receive the next event of kind, fails if it doesn't come
+func (l eventLogger) next(t *testing.T, kind LogKind) LogEvent {
+	t.Helper()
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case e := <-l:
+			if e.Kind == kind {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", kind)
+			return LogEvent{}
+		}
+	}
+}
+
+// the server logs to its Logger instead of the log package
+func TestServerLogger(t *testing.T) {
+	a, b := Pipe()
+	defer b.Close()
+	s := NewServer(a)
+	defer s.Close()
+	l := make(eventLogger, 8)
+	s.SetLogger(l)
+	go s.Serve()
+
+	m := MessageBuild(TransactionID, BindingRequest)
+	m.Raw[0] = 0xc0 // the most significant 2 bits are not zero
+	b.Write(m.Raw)
+	if e := l.next(t, LogDecodeError); e.Err == nil || e.From == nil {
+		t.Fatalf("event is %+v", e)
+	}
+}
+
+func TestClientLoggerResponseSent(t *testing.T) {
+	l := make(eventLogger, 8)
+	c, peer := testClient(t, WithLogger(l))
+	h := make(eventHandler, 1)
+	c.SetRequestHandler(h)
+	req := MessageBuild(TransactionID, BindingRequest)
+	peer.Write(req.Raw)
+	e := h.next(t)
+	res := &Message{TransactionID: req.TransactionID}
+	if err := res.Build(BindingSuccess); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Respond(res); err != nil {
+		t.Fatal(err)
+	}
+	if e := l.next(t, LogResponseSent); e.ID != req.TransactionID || e.Type != BindingSuccess {
+		t.Fatalf("event is %+v", e)
+	}
+	if m := readRequest(t, peer); m.Type != BindingSuccess {
+		t.Fatalf("peer received %s", m.Type)
+	}
+}
@@ -0,0 +1,190 @@
+package gostun
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// count of the datagrams which are queued to be read, more are dropped like UDP
+const memConnQueue = 64
+
+// in-memory datagram connection for testing, which is created by Pipe.
+// it implements net.Conn for NewClient and net.PacketConn for NewServer.
+// each Write is read by one Read of the peer, and it is lost if the peer is closed
+type MemConn struct {
+	in     chan []byte
+	peer   *MemConn
+	local  *net.UDPAddr
+	closed chan struct{}
+	once   sync.Once
+
+	mux      sync.Mutex // guards drop, delay, deadline and wake
+	drop     func(b []byte) bool
+	delay    time.Duration
+	deadline time.Time     // read deadline
+	wake     chan struct{} // closed when deadline is changed
+}
+
+// returns the connected MemConns, their addresses are distinct UDP addresses of loopback
+func Pipe() (*MemConn, *MemConn) {
+	a := newMemConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	b := newMemConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2})
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func newMemConn(local *net.UDPAddr) *MemConn {
+	return &MemConn{
+		in:     make(chan []byte, memConnQueue),
+		local:  local,
+		closed: make(chan struct{}),
+		wake:   make(chan struct{}),
+	}
+}
+
+// datagrams written by c are dropped if f reports true, nil drops nothing
+func (c *MemConn) SetDrop(f func(b []byte) bool) {
+	c.mux.Lock()
+	c.drop = f
+	c.mux.Unlock()
+}
+
+// datagrams written by c are delivered to the peer after d
+func (c *MemConn) SetDelay(d time.Duration) {
+	c.mux.Lock()
+	c.delay = d
+	c.mux.Unlock()
+}
+
+// b is read by c as if the peer wrote it, e.g. malformed message
+func (c *MemConn) Inject(b []byte) {
+	c.deliver(append([]byte(nil), b...))
+}
+
+func (c *MemConn) deliver(b []byte) {
+	select {
+	case c.in <- b:
+	case <-c.closed:
+	default: // queue is full
+	}
+}
+
+func (c *MemConn) Read(b []byte) (int, error) {
+	for {
+		c.mux.Lock()
+		deadline, wake := c.deadline, c.wake
+		c.mux.Unlock()
+
+		select {
+		case <-c.closed:
+			return 0, net.ErrClosed
+		default:
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		var (
+			t       *time.Timer
+			timeout <-chan time.Time
+		)
+		if !deadline.IsZero() {
+			t = time.NewTimer(time.Until(deadline))
+			timeout = t.C
+		}
+
+		var (
+			n   int
+			err error
+			ok  = true
+		)
+		select {
+		case p := <-c.in:
+			n = copy(b, p) // the rest of p is discarded like UDP
+		case <-c.closed:
+			err = net.ErrClosed
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-wake:
+			ok = false // deadline is changed
+		}
+		if t != nil {
+			t.Stop()
+		}
+		if ok {
+			return n, err
+		}
+	}
+}
+
+func (c *MemConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	if err != nil {
+		return n, nil, err
+	}
+	return n, c.peer.local, nil
+}
+
+func (c *MemConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.mux.Lock()
+	drop, delay := c.drop, c.delay
+	c.mux.Unlock()
+
+	if drop != nil && drop(b) {
+		return len(b), nil
+	}
+	p := append([]byte(nil), b...)
+	if delay > 0 {
+		time.AfterFunc(delay, func() { c.peer.deliver(p) })
+	} else {
+		c.peer.deliver(p)
+	}
+	return len(b), nil
+}
+
+// addr is ignored, the datagram is written to the peer
+func (c *MemConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+func (c *MemConn) Close() error {
+	err := net.ErrClosed
+	c.once.Do(func() {
+		close(c.closed)
+		err = nil
+	})
+	return err
+}
+
+func (c *MemConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *MemConn) RemoteAddr() net.Addr {
+	return c.peer.local
+}
+
+func (c *MemConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *MemConn) SetReadDeadline(t time.Time) error {
+	c.mux.Lock()
+	c.deadline = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+	c.mux.Unlock()
+	return nil
+}
+
+// writes don't block, so the write deadline is ignored
+func (c *MemConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
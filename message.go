@@ -11,7 +11,8 @@ const (
 	magicCookie       = 0x2112A442
 	TransactionIDSize = 12 // 96 bit
 	messageHeader     = 20
-	attributeHeader   = 4 // type and length
+	attributeHeader   = 4      // type and length
+	maxMessageLength  = 0xFFFF // Message Length is 16 bits
 )
 
 const (
@@ -31,10 +32,22 @@ type MessageClass byte
 
 // class
 const (
-	Request         MessageClass = 0x00
-	Indication      MessageClass = 0x01
-	SuccessResponse MessageClass = 0x02
-	ErrorResponse   MessageClass = 0x03
+	ClassRequest         MessageClass = 0x00
+	ClassIndication      MessageClass = 0x01
+	ClassSuccessResponse MessageClass = 0x02
+	ClassErrorResponse   MessageClass = 0x03
+)
+
+// class names before the Class prefix
+const (
+	// Deprecated: use ClassRequest
+	Request = ClassRequest
+	// Deprecated: use ClassIndication
+	Indication = ClassIndication
+	// Deprecated: use ClassSuccessResponse
+	SuccessResponse = ClassSuccessResponse
+	// Deprecated: use ClassErrorResponse
+	ErrorResponse = ClassErrorResponse
 )
 
 type Method uint16
@@ -42,13 +55,23 @@ type Method uint16
 // method
 const (
 	MethodBinding Method = 0x001
+
+	// TURN: RFC 5766 page 42
+	MethodAllocate         Method = 0x003
+	MethodRefresh          Method = 0x004
+	MethodSend             Method = 0x006
+	MethodData             Method = 0x007
+	MethodCreatePermission Method = 0x008
+	MethodChannelBind      Method = 0x009
 )
 
 // Binding Message type
 var (
-	BindingRequest = NewMessageType(MethodBinding, Request)
-	BindingSuccess = NewMessageType(MethodBinding, SuccessResponse)
-	BindingError   = NewMessageType(MethodBinding, ErrorResponse)
+	BindingRequest = NewMessageType(MethodBinding, ClassRequest)
+	BindingSuccess = NewMessageType(MethodBinding, ClassSuccessResponse)
+	BindingError   = NewMessageType(MethodBinding, ClassErrorResponse)
+
+	BindingIndication = NewMessageType(MethodBinding, ClassIndication)
 )
 
 // STUN Message Type Field.
@@ -66,7 +89,7 @@ type Message struct {
 	Attributes    Attributes
 }
 
-//reutn new message type has Method and Class
+// reutn new message type has Method and Class
 func NewMessageType(m Method, c MessageClass) MessageType {
 	return MessageType{
 		Method: m,
@@ -74,16 +97,125 @@ func NewMessageType(m Method, c MessageClass) MessageType {
 	}
 }
 
+func (m *Message) Method() Method {
+	return m.Type.Method
+}
+
+func (m *Message) IsRequest() bool {
+	return m.Type.Class == ClassRequest
+}
+
+func (m *Message) IsIndication() bool {
+	return m.Type.Class == ClassIndication
+}
+
+func (m *Message) IsSuccessResponse() bool {
+	return m.Type.Class == ClassSuccessResponse
+}
+
+func (m *Message) IsErrorResponse() bool {
+	return m.Type.Class == ClassErrorResponse
+}
+
+// success or error response
+func (m *Message) IsResponse() bool {
+	return m.IsSuccessResponse() || m.IsErrorResponse()
+}
+
+// read one datagram into m.Raw and decode it, the size of the datagram is len(m.Raw) at most
 func (m *Message) ReadConn(r io.Reader) (int, error) {
 	n, err := r.Read(m.Raw)
 	if err != nil {
 		return n, err
 	}
+	full := n == len(m.Raw)
 	m.Raw = m.Raw[:n]
+	if full && m.truncated() {
+		return n, ErrMessageTruncated
+	}
 
 	return n, m.Decode()
 }
 
+// truncated reports m.Raw is shorter than the Message Length of the header,
+// which means the datagram was larger than the read buffer
+func (m *Message) truncated() bool {
+	if len(m.Raw) < messageHeader || binary.BigEndian.Uint32(m.Raw[4:8]) != magicCookie {
+		return false
+	}
+	return messageHeader+int(binary.BigEndian.Uint16(m.Raw[2:4])) > len(m.Raw)
+}
+
+/*
+   When STUN is run over TCP or TLS, the messages are read from the stream,
+   so the 20 bytes header is read first, and then the rest of the message
+   whose size is the Message Length.  A read of the stream may return a part
+   of them, so both are read by io.ReadFull until they are complete.
+*/
+
+// read one STUN message from stream r and decode it
+func (m *Message) ReadConnFramed(r io.Reader) error {
+	_, err := m.ReadFrom(r)
+	return err
+}
+
+// io.ReaderFrom, read one framed message from r and decode it.
+// n is the count of the bytes read from r, even if err is not nil
+func (m *Message) ReadFrom(r io.Reader) (int64, error) {
+	m.grow(messageHeader)
+	n, err := io.ReadFull(r, m.Raw)
+	if err != nil {
+		return int64(n), err
+	}
+	if binary.BigEndian.Uint32(m.Raw[4:8]) != magicCookie {
+		return int64(n), ErrNotSTUN // can't find the next message in the stream
+	}
+
+	mlength := int(binary.BigEndian.Uint16(m.Raw[2:4]))
+	m.grow(messageHeader + mlength)
+	body, err := io.ReadFull(r, m.Raw[messageHeader:])
+	n += body
+	if err != nil {
+		return int64(n), err
+	}
+
+	return int64(n), m.Decode()
+}
+
+// io.WriterTo, write m.Raw to w. m is encoded if m.Raw has no header
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	if len(m.Raw) < messageHeader {
+		m.Encode()
+	}
+	n, err := w.Write(m.Raw)
+	return int64(n), err
+}
+
+// copy m to b, b does not share m.Raw and the attribute values with m
+func (m *Message) CopyTo(b *Message) error {
+	b.Raw = append(b.Raw[:0], m.Raw...)
+	return b.Decode()
+}
+
+// returns deep copy of m, which is safe to keep after m is released
+func (m *Message) Clone() *Message {
+	b := &Message{
+		Raw:           append([]byte(nil), m.Raw...),
+		Type:          m.Type,
+		Length:        m.Length,
+		TransactionID: m.TransactionID,
+		Attributes:    make(Attributes, len(m.Attributes)),
+	}
+	for i, a := range m.Attributes {
+		b.Attributes[i] = AttributeField{
+			Type:   a.Type,
+			Length: a.Length,
+			Value:  append([]byte(nil), a.Value...),
+		}
+	}
+	return b
+}
+
 /*
     0                   1                   2                   3
     0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
@@ -100,32 +232,64 @@ func (m *Message) ReadConn(r io.Reader) (int, error) {
                         Format of STUN Message Header
 */
 
+var (
+	ErrNotSTUN   = errors.New("not STUN message")
+	ErrBadLength = errors.New("message length is not a multiple of 4")
+
+	ErrMessageTruncated = errors.New("message is larger than the read buffer")
+
+	ErrBufferTooSmall = errors.New("buffer is smaller than the message")
+)
+
+// m.Raw has the header and the attributes of the Message Length,
+// so the header can be decoded without indexing out of range
+func (m *Message) CheckSize() error {
+	if len(m.Raw) < messageHeader {
+		return ErrBufferTooSmall
+	}
+	if len(m.Raw) < messageHeader+int(binary.BigEndian.Uint16(m.Raw[2:4])) {
+		return ErrBufferTooSmall
+	}
+	return nil
+}
+
+// The most significant 2 bits of every STUN message MUST be zeroes.
+// m.Raw is read from the network, so any malformed message is an error, never a panic
 func (m *Message) Decode() error {
 	header := m.Raw
+	if len(header) < messageHeader {
+		return ErrBufferTooSmall
+	}
 	mtype := binary.BigEndian.Uint16(header[0:2])   //STUN Message type
 	mlength := binary.BigEndian.Uint16(header[2:4]) //STUN Message length
 	mcookie := binary.BigEndian.Uint32(header[4:8]) //Magic Cookie
 	fullHeader := messageHeader + int(mlength)      //len(m.Raw)
 
-	// check magic cookie
-	if mcookie != magicCookie {
-		err := fmt.Sprintf("%x is invalid value magicCookie is %x\n", mcookie, magicCookie)
-		return errors.New(err)
+	// check first 2 bits and magic cookie
+	if header[0]&0xc0 != 0 || mcookie != magicCookie {
+		return ErrNotSTUN
+	}
+	// attributes are padded to 4 bytes
+	if mlength%4 != 0 {
+		return ErrBadLength
 	}
 	// check header size
-	if len(header) < fullHeader {
-		err := fmt.Sprintf("this length %d is less than %d", len(header), fullHeader)
+	if err := m.CheckSize(); err != nil {
+		return err
+	}
+	if len(header) > fullHeader {
+		err := fmt.Sprintf("length field %d disagrees with %d bytes of attributes", mlength, len(header)-messageHeader)
 		return errors.New(err)
 	}
 
-	m.Type.DecodeMessageType(mtype)                   // copy STUN message type
+	m.Type.ReadValue(mtype)                           // copy STUN message type
 	m.Length = uint32(mlength)                        // copy STUN message type
 	copy(m.TransactionID[:], header[8:messageHeader]) // copy STUN Transaction ID (96 bits|12 byte)
 	if err := m.AttrDecode(header[messageHeader:fullHeader], int(mlength)); err != nil {
 		return err
 	}
 
-	return nil
+	return m.checkOrder()
 }
 
 /*
@@ -141,7 +305,7 @@ func (m *Message) Decode() error {
 */
 
 // Decode according Format of STUN message type field
-func (mt *MessageType) DecodeMessageType(v uint16) {
+func (mt *MessageType) ReadValue(v uint16) {
 	// difine class
 	c0 := (v >> shiftc0) & bitc0
 	c1 := (v >> shiftc1) & bitc1
@@ -157,22 +321,79 @@ func (mt *MessageType) DecodeMessageType(v uint16) {
 	mt.Method = Method(m)
 }
 
+// Encode according Format of STUN message type field
+func (mt MessageType) Value() uint16 {
+	// Class
+	class := uint16(mt.Class)
+	c0 := (class & bitc0) << shiftc0 // 4 bit shift
+	c1 := (class & bitc1) << shiftc1 // 7 bit shift
+	c := c0 + c1
+
+	// Method
+	method := uint16(mt.Method)
+	m1m3 := method & mbit1
+	m4m6 := method & mbit2
+	m7m11 := method & mbit3
+	method = m1m3 + (m4m6 << methodshift1) + (m7m11 << methodshift2)
+
+	return c + method
+}
+
 // Attribute decode
+/*
+   MESSAGE-INTEGRITY is the last attribute except for MESSAGE-INTEGRITY-SHA256
+   and FINGERPRINT, MESSAGE-INTEGRITY-SHA256 is the last one except for
+   FINGERPRINT, and FINGERPRINT is the last attribute.  Otherwise the integrity and the
+   fingerprint are computed over the wrong range of the message.
+   The comprehension-optional attributes after the integrity are not an error,
+   since newer servers may add them, e.g. vendor attributes.  The integrity
+   does not cover them, so they MUST be ignored (RFC 8489 section 14.5)
+   and are dropped from m.Attributes.  m.Raw still has them.
+*/
+
+func (m *Message) checkOrder() error {
+	integrity, sha256 := false, false
+	kept := m.Attributes[:0] // filtered in place
+	for i, attr := range m.Attributes {
+		if attr.Type == FINGERPRINT && i != len(m.Attributes)-1 {
+			return ErrAttributeAfterFingerprint
+		}
+		if (integrity || sha256) && attr.Type != FINGERPRINT && !attr.Type.Required() {
+			continue // ignored
+		}
+		if sha256 && attr.Type != FINGERPRINT {
+			return ErrAttributeAfterIntegrity
+		}
+		if integrity && attr.Type != FINGERPRINT && attr.Type != MESSAGE_INTEGRITY_SHA256 {
+			return ErrAttributeAfterIntegrity
+		}
+		switch attr.Type {
+		case MESSAGE_INTEGRITY:
+			integrity = true
+		case MESSAGE_INTEGRITY_SHA256:
+			sha256 = true
+		}
+		kept = append(kept, attr)
+	}
+	m.Attributes = kept
+	return nil
+}
+
 func (m *Message) AttrDecode(buf []byte, l int) error {
 	m.Attributes = m.Attributes[:0]
 	attrsize := 0 // initialize
 
 	for attrsize < l {
-		attr := AttributeField{
-			Type:   AttributeType(binary.BigEndian.Uint16(buf[0:2])), //Attribute type - first 2byte
-			Length: binary.BigEndian.Uint16(buf[2:4]),                // Attributes Length - next 2byte
-		}
-
 		if len(buf) < attributeHeader {
 			err := fmt.Sprintf("buf(%d) is less than attributeHeader(%d)", len(buf), attributeHeader)
 			return errors.New(err)
 		}
 
+		attr := AttributeField{
+			Type:   AttributeType(binary.BigEndian.Uint16(buf[0:2])), //Attribute type - first 2byte
+			Length: binary.BigEndian.Uint16(buf[2:4]),                // Attributes Length - next 2byte
+		}
+
 		alen := attr.PaddingValue() // padding
 		attrsize += attributeHeader // increment attrsize 4byte(type + length)
 		buf = buf[attributeHeader:] // adjust 4 byte buf to Value
@@ -0,0 +1,99 @@
+package gostun
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// captured messages: RFC 5769 section 2.1 request, 2.2 IPv4 response and 2.3 IPv6 response
+var fuzzSeedHex = []string{
+	"000100582112a442b7e7a701bc34d686fa87dfae802200105354554e207465737420636c69656e74002400046e0001ff80290008932ff9b151263b36000600096576746a3a68367659202020000800149aeaa70cbfd8cb56781ef2b5b2d3f249c1b571a280280004e57a3bcf",
+	"0101003c2112a442b7e7a701bc34d686fa87dfae8022000b7465737420766563746f7220002000080001a147e112a643000800142b91f599fd9e90c38c7489f92af9ba53f06be7d780280004c07d4c96",
+	"010100482112a442b7e7a701bc34d686fa87dfae8022000b7465737420766563746f7220002000140002a1470113a9faa5d3f179bc25f4b5bed2b9d900080014a382954e4be67bf11784c97c8292c275bfe3ed4180280004c8fb0b4c",
+}
+
+// malformed messages built from a valid header
+func fuzzSeedMalformed() [][]byte {
+	header := func(length byte) []byte {
+		return []byte{
+			0x01, 0x01, 0x00, length, 0x21, 0x12, 0xa4, 0x42,
+			1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12,
+		}
+	}
+	return [][]byte{
+		// short attribute: XOR-MAPPED-ADDRESS of 2 bytes
+		append(header(8), 0x00, 0x20, 0x00, 0x02, 0x00, 0x01, 0x00, 0x00),
+		// bogus length: attribute length is more than the message
+		append(header(8), 0x00, 0x01, 0x00, 0x40, 0x00, 0x01, 0x00, 0x00),
+		// bogus length: message length is more than the buffer
+		append(header(64), 0x00, 0x01, 0x00, 0x08, 0x00, 0x01, 0x00, 0x00),
+		// bad address family of MAPPED-ADDRESS
+		append(header(12), 0x00, 0x01, 0x00, 0x08, 0x00, 0x07, 0x00, 0x01, 1, 2, 3, 4),
+		// IPv6 family with IPv4 length of XOR-MAPPED-ADDRESS
+		append(header(12), 0x00, 0x20, 0x00, 0x08, 0x00, 0x02, 0x00, 0x01, 1, 2, 3, 4),
+		// short ERROR-CODE
+		append(header(8), 0x00, 0x09, 0x00, 0x02, 0x00, 0x04, 0x00, 0x00),
+		// truncated header
+		header(0)[:19],
+	}
+}
+
+// Decode must not panic on any input, and the decoded message is encoded to the same attributes
+func FuzzDecode(f *testing.F) {
+	for _, s := range fuzzSeedHex {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	for _, b := range fuzzSeedMalformed() {
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m := &Message{Raw: append([]byte(nil), b...)}
+		if err := m.Decode(); err != nil {
+			return
+		}
+
+		// getters of the decoded message must not panic either
+		_ = m.String()
+		var (
+			mapped MappedAddress
+			xor    XORMappedAddress
+			code   ErrorCodeAttribute
+			u      UnknownAttributes
+		)
+		mapped.GetFrom(m)
+		xor.GetFrom(m)
+		code.GetFrom(m)
+		u.GetFrom(m)
+		m.ReflexiveAddress()
+		FingerprintAttr.Check(m)
+		MessageIntegrity("key").Check(m)
+
+		e := &Message{
+			Type:          m.Type,
+			TransactionID: m.TransactionID,
+			Attributes:    append(Attributes(nil), m.Attributes...),
+		}
+		e.Encode()
+		d := &Message{Raw: e.Raw}
+		if err := d.Decode(); err != nil {
+			t.Fatalf("decode of encoded message: %v", err)
+		}
+		if d.Type != m.Type || d.TransactionID != m.TransactionID {
+			t.Fatalf("header %s %x, want %s %x", d.Type, d.TransactionID, m.Type, m.TransactionID)
+		}
+		if len(d.Attributes) != len(m.Attributes) {
+			t.Fatalf("%d attributes, want %d", len(d.Attributes), len(m.Attributes))
+		}
+		for i, a := range d.Attributes {
+			if a.Type != m.Attributes[i].Type || !bytes.Equal(a.Value, m.Attributes[i].Value) {
+				t.Fatalf("attribute %d is %s %x, want %s %x", i, a.Type, a.Value, m.Attributes[i].Type, m.Attributes[i].Value)
+			}
+		}
+	})
+}
@@ -0,0 +1,261 @@
+package gostun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// the length of the attribute is not padded, the value is followed by the padding on the wire
+func TestAttributePadding(t *testing.T) {
+	for _, v := range [][]byte{{1}, {1, 2}, {1, 2, 3}} {
+		m := MessageBuild(TransactionID, BindingRequest)
+		if err := m.Add(USERNAME, v); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Add(SOFTWARE, []byte{4, 5, 6, 7}); err != nil {
+			t.Fatal(err)
+		}
+		if want := attributeHeader*2 + 4 + 4; int(m.Length) != want || len(m.Raw) != messageHeader+want {
+			t.Fatalf("%d bytes value: length %d, raw %d, want %d", len(v), m.Length, len(m.Raw), want)
+		}
+
+		d := &Message{Raw: append([]byte(nil), m.Raw...)}
+		if err := d.Decode(); err != nil {
+			t.Fatal(err)
+		}
+		a, ok := d.Get(USERNAME)
+		if !ok {
+			t.Fatal("no USERNAME")
+		}
+		if int(a.Length) != len(v) || !bytes.Equal(a.Value, v) {
+			t.Fatalf("decoded %x with length %d, want %x", a.Value, a.Length, v)
+		}
+		if a, ok := d.Get(SOFTWARE); !ok || !bytes.Equal(a.Value, []byte{4, 5, 6, 7}) {
+			t.Fatalf("attribute after %d bytes value is %x", len(v), a.Value)
+		}
+	}
+}
+
+func TestMessageGetAll(t *testing.T) {
+	m := MessageBuild(TransactionID, NewMessageType(MethodCreatePermission, ClassRequest))
+	values := [][]byte{{1, 1, 1, 1}, {2, 2, 2, 2}, {3, 3, 3, 3}}
+	for i, v := range values {
+		if err := m.Add(XOR_PEER_ADDRESS, v); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			m.Add(SOFTWARE, []byte("x")) // the other type between them
+		}
+	}
+
+	d := &Message{Raw: append([]byte(nil), m.Raw...)}
+	if err := d.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	all := d.GetAll(XOR_PEER_ADDRESS)
+	if len(all) != len(values) {
+		t.Fatalf("%d attributes, want %d", len(all), len(values))
+	}
+	for i, a := range all {
+		if !bytes.Equal(a.Value, values[i]) {
+			t.Fatalf("attribute %d is %x, want %x", i, a.Value, values[i])
+		}
+	}
+	if all := d.GetAll(USERNAME); len(all) != 0 {
+		t.Fatalf("%d USERNAME, want 0", len(all))
+	}
+}
+
+// the length field of the header follows each attribute, including MESSAGE-INTEGRITY and FINGERPRINT
+func TestMessageLengthIncremental(t *testing.T) {
+	m := MessageBuild(TransactionID, BindingRequest)
+	check := func(step string, want int) {
+		t.Helper()
+		if got := int(binary.BigEndian.Uint16(m.Raw[2:4])); got != want || int(m.Length) != want {
+			t.Fatalf("after %s: header length %d, Length %d, want %d", step, got, m.Length, want)
+		}
+		if len(m.Raw) != messageHeader+want {
+			t.Fatalf("after %s: raw %d bytes, want %d", step, len(m.Raw), messageHeader+want)
+		}
+	}
+	check("header", 0)
+	m.Add(SOFTWARE, []byte("abcde"))
+	check("SOFTWARE", 12)
+	m.Add(USERNAME, []byte("user"))
+	check("USERNAME", 20)
+	if err := MessageIntegrity("key").AddTo(m); err != nil {
+		t.Fatal(err)
+	}
+	check("MESSAGE-INTEGRITY", 44)
+	if err := FingerprintAttr.AddTo(m); err != nil {
+		t.Fatal(err)
+	}
+	check("FINGERPRINT", 52)
+	if err := MessageIntegrity("key").Check(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := FingerprintAttr.Check(m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the checks do not change m.Raw, so a received message can be checked by goroutines at once, run with -race
+func TestMessageCheckConcurrent(t *testing.T) {
+	m := MessageBuild(TransactionID, BindingRequest, Username("user"), MessageIntegrity("key"), FingerprintAttr)
+	raw := append([]byte(nil), m.Raw...)
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			if err := MessageIntegrity("key").Check(m); err != nil {
+				errs <- err
+				return
+			}
+			errs <- FingerprintAttr.Check(m)
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(m.Raw, raw) {
+		t.Fatalf("raw is %x after the checks, want %x", m.Raw, raw)
+	}
+}
+
+// the messages of the stream are reassembled from the reads of one byte
+func TestMessageReadFromOneByte(t *testing.T) {
+	first := MessageBuild(TransactionID, BindingRequest, Software("abcde"))
+	second := MessageBuild(TransactionID, BindingSuccess, &XORMappedAddress{IP: testIPv6, Port: 1000})
+	stream := append(append([]byte(nil), first.Raw...), second.Raw...)
+
+	r := iotest.OneByteReader(bytes.NewReader(stream))
+	for _, want := range []*Message{first, second} {
+		m := new(Message)
+		n, err := m.ReadFrom(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(n) != len(want.Raw) || !bytes.Equal(m.Raw, want.Raw) {
+			t.Fatalf("read %d bytes %x, want %x", n, m.Raw, want.Raw)
+		}
+		if m.Type != want.Type || m.TransactionID != want.TransactionID || len(m.Attributes) != len(want.Attributes) {
+			t.Fatalf("decoded %s, want %s", m, want)
+		}
+	}
+
+	// the last byte is not in the stream
+	r = iotest.OneByteReader(bytes.NewReader(stream[len(first.Raw) : len(stream)-1]))
+	if _, err := new(Message).ReadFrom(r); err != io.ErrUnexpectedEOF {
+		t.Fatalf("err is %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestMessageCheckSize(t *testing.T) {
+	header := MessageBuild(TransactionID, BindingRequest).Raw
+	for _, tc := range []struct {
+		raw []byte
+		err error
+	}{
+		{nil, ErrBufferTooSmall},
+		{make([]byte, 0), ErrBufferTooSmall},
+		{header[:19], ErrBufferTooSmall},
+		{header[:20], nil},
+	} {
+		m := &Message{Raw: tc.raw}
+		if err := m.CheckSize(); err != tc.err {
+			t.Fatalf("%d bytes: CheckSize is %v, want %v", len(tc.raw), err, tc.err)
+		}
+		if err := m.Decode(); err != tc.err {
+			t.Fatalf("%d bytes: Decode is %v, want %v", len(tc.raw), err, tc.err)
+		}
+	}
+
+	// the header of 20 bytes which declares 8 bytes of the attributes
+	m := MessageBuild(TransactionID, BindingRequest, Software("abcd"))
+	m.Raw = m.Raw[:messageHeader]
+	if err := m.CheckSize(); err != ErrBufferTooSmall {
+		t.Fatalf("CheckSize of the truncated body is %v, want %v", err, ErrBufferTooSmall)
+	}
+}
+
+// Build of the reused message writes the new message from the start
+func TestMessageBuildReuse(t *testing.T) {
+	m := MessageBuild(TransactionID, BindingRequest, Software("abcde"))
+	if err := m.Build(TransactionID, BindingSuccess); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Raw) != messageHeader || m.Length != 0 || len(m.Attributes) != 0 {
+		t.Fatalf("raw %d bytes, length %d, %d attributes", len(m.Raw), m.Length, len(m.Attributes))
+	}
+	d := &Message{Raw: append([]byte(nil), m.Raw...)}
+	if err := d.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Type != BindingSuccess || d.TransactionID != m.TransactionID {
+		t.Fatalf("decoded %s, want %s", d, m)
+	}
+}
+
+// the length field is restored when MESSAGE-INTEGRITY or FINGERPRINT can't be added
+func TestMessageLengthRestored(t *testing.T) {
+	m := MessageBuild(TransactionID, BindingRequest)
+	if err := (MessageIntegritySHA256{Key: []byte("key")}).AddTo(m); err != nil {
+		t.Fatal(err)
+	}
+	want := binary.BigEndian.Uint16(m.Raw[2:4])
+	if err := MessageIntegrity("key").AddTo(m); err == nil {
+		t.Fatal("MESSAGE-INTEGRITY is added after MESSAGE-INTEGRITY-SHA256")
+	}
+	if got := binary.BigEndian.Uint16(m.Raw[2:4]); got != want {
+		t.Fatalf("length is %d after MESSAGE-INTEGRITY, want %d", got, want)
+	}
+
+	// FINGERPRINT makes the message longer than the max length
+	m = MessageBuild(TransactionID, BindingRequest)
+	if err := m.Add(DATA, make([]byte, maxMessageLength-attributeHeader-3)); err != nil {
+		t.Fatal(err)
+	}
+	want = binary.BigEndian.Uint16(m.Raw[2:4])
+	if err := FingerprintAttr.AddTo(m); err == nil {
+		t.Fatal("FINGERPRINT is added over the max length")
+	}
+	if got := binary.BigEndian.Uint16(m.Raw[2:4]); got != want {
+		t.Fatalf("length is %d after FINGERPRINT, want %d", got, want)
+	}
+}
+
+// RFC 8489 section 14.5: the comprehension-optional attributes after MESSAGE-INTEGRITY are ignored
+func TestDecodeIgnoredAfterIntegrity(t *testing.T) {
+	m := MessageBuild(TransactionID, BindingRequest, Username("user"), MessageIntegrity("key"))
+	// SOFTWARE "abc" is written after MESSAGE-INTEGRITY, which Add refuses
+	m.Raw = append(m.Raw, 0x80, 0x22, 0x00, 0x03, 'a', 'b', 'c', 0x00)
+	m.setLength()
+	if err := FingerprintAttr.AddTo(m); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Message{Raw: append([]byte(nil), m.Raw...)}
+	if err := d.Decode(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Get(SOFTWARE); ok {
+		t.Fatal("SOFTWARE after MESSAGE-INTEGRITY is not ignored")
+	}
+	var types []AttributeType
+	for _, a := range d.Attributes {
+		types = append(types, a.Type)
+	}
+	if len(types) != 3 || types[0] != USERNAME || types[1] != MESSAGE_INTEGRITY || types[2] != FINGERPRINT {
+		t.Fatalf("attributes are %v", types)
+	}
+	if err := MessageIntegrity("key").Check(d); err != nil {
+		t.Fatal(err)
+	}
+	if err := FingerprintAttr.Check(d); err != nil {
+		t.Fatal(err)
+	}
+}
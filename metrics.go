@@ -0,0 +1,62 @@
+package gostun
+
+import "sync/atomic"
+
+// counters of the client and its agent, reference prometheus.Counter.
+// the methods are called from the loops of the client, so they must not block.
+// each started transaction is counted once by TransactionCompleted, TransactionTimedOut or TransactionCancelled
+type Metrics interface {
+	TransactionStarted()
+	TransactionCompleted() // the response is received
+	TransactionTimedOut()
+	TransactionCancelled() // by Stop, StopBy, CancelHandle or Close
+	BytesRead(n int)
+	BytesWritten(n int)
+}
+
+// default Metrics
+type nopMetrics struct{}
+
+func (nopMetrics) TransactionStarted()   {}
+func (nopMetrics) TransactionCompleted() {}
+func (nopMetrics) TransactionTimedOut()  {}
+func (nopMetrics) TransactionCancelled() {}
+func (nopMetrics) BytesRead(int)         {}
+func (nopMetrics) BytesWritten(int)      {}
+
+// set m as the Metrics of c and its agent, nil resets the no-op default
+func (c *Client) SetMetrics(m Metrics) {
+	if m == nil {
+		m = nopMetrics{}
+	}
+	c.rw.Lock()
+	c.metrics = m
+	c.rw.Unlock()
+
+	if a, ok := c.agent.(interface {
+		SetMetrics(Metrics)
+	}); ok {
+		a.SetMetrics(m)
+	}
+}
+
+func (c *Client) getMetrics() Metrics {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+	return c.metrics
+}
+
+// transactions are counted by the agent
+func (a *Agent) SetMetrics(m Metrics) {
+	if m == nil {
+		m = nopMetrics{}
+	}
+	a.mux.Lock()
+	a.metrics = m
+	a.mux.Unlock()
+}
+
+// returns the count of in-flight transactions
+func (a *Agent) Len() int {
+	return int(atomic.LoadInt64(&a.count))
+}
@@ -0,0 +1,305 @@
+package gostun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+/*
+   CHANGE-REQUEST:
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 0 A B 0|
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   A: change IP, B: change port
+
+   RESPONSE-PORT: 16-bit port and 16 bits padding.
+   RESPONSE-ORIGIN and OTHER-ADDRESS: same format as MAPPED-ADDRESS.
+*/
+
+const (
+	changeRequestSize = 4
+	changeIPFlag      = 0x04
+	changePortFlag    = 0x02
+	responsePortSize  = 4
+)
+
+type ChangeRequest struct {
+	ChangeIP   bool
+	ChangePort bool
+}
+
+func (c ChangeRequest) AddTo(m *Message) error {
+	v := make([]byte, changeRequestSize)
+	if c.ChangeIP {
+		v[3] |= changeIPFlag
+	}
+	if c.ChangePort {
+		v[3] |= changePortFlag
+	}
+	return m.Add(CHANGE_REQUEST, v)
+}
+
+func (c *ChangeRequest) GetFrom(m *Message) error {
+	v, err := m.GetRapped(CHANGE_REQUEST)
+	if err != nil {
+		return err
+	}
+	if len(v) != changeRequestSize {
+		err := fmt.Sprintf("CHANGE-REQUEST length(%d) is not %d", len(v), changeRequestSize)
+		return errors.New(err)
+	}
+	flags, err := getU32(v, 0)
+	if err != nil {
+		return err
+	}
+	c.ChangeIP = flags&changeIPFlag != 0
+	c.ChangePort = flags&changePortFlag != 0
+	return nil
+}
+
+type ResponsePort uint16
+
+func (p ResponsePort) AddTo(m *Message) error {
+	v := make([]byte, responsePortSize)
+	putU16(v, 0, uint16(p))
+	return m.Add(RESPONSE_PORT, v)
+}
+
+func (p *ResponsePort) GetFrom(m *Message) error {
+	v, err := m.GetRapped(RESPONSE_PORT)
+	if err != nil {
+		return err
+	}
+	if len(v) != responsePortSize {
+		err := fmt.Sprintf("RESPONSE-PORT length(%d) is not %d", len(v), responsePortSize)
+		return errors.New(err)
+	}
+	port, err := getU16(v, 0)
+	if err != nil {
+		return err
+	}
+	*p = ResponsePort(port)
+	return nil
+}
+
+/*
+   PADDING: the value is ignored, it is used to make the message larger
+   than the MTU to test the fragmentation.
+   CACHE-TIMEOUT: 32-bit unsigned integral number of seconds, the duration
+   for which the server keeps the binding state.
+*/
+
+const cacheTimeoutSize = 4
+
+// PADDING of n zero bytes
+type Padding int
+
+func (p Padding) AddTo(m *Message) error {
+	if p < 0 {
+		err := fmt.Sprintf("PADDING length(%d) is negative", int(p))
+		return errors.New(err)
+	}
+	return m.Add(PADDING, make([]byte, int(p)))
+}
+
+// the length of PADDING
+func (p *Padding) GetFrom(m *Message) error {
+	v, err := m.GetRapped(PADDING)
+	if err != nil {
+		return err
+	}
+	*p = Padding(len(v))
+	return nil
+}
+
+// CACHE-TIMEOUT in seconds
+type CacheTimeout time.Duration
+
+func (t CacheTimeout) AddTo(m *Message) error {
+	v := make([]byte, cacheTimeoutSize)
+	binary.BigEndian.PutUint32(v, uint32(time.Duration(t)/time.Second))
+	return m.Add(CACHE_TIMEOUT, v)
+}
+
+func (t *CacheTimeout) GetFrom(m *Message) error {
+	v, err := m.GetRapped(CACHE_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	if len(v) != cacheTimeoutSize {
+		err := fmt.Sprintf("CACHE-TIMEOUT length(%d) is not %d", len(v), cacheTimeoutSize)
+		return errors.New(err)
+	}
+	sec, err := getU32(v, 0)
+	if err != nil {
+		return err
+	}
+	*t = CacheTimeout(time.Duration(sec) * time.Second)
+	return nil
+}
+
+type ResponseOrigin Addr
+
+func (addr *ResponseOrigin) AddTo(m *Message) error {
+	return (*Addr)(addr).encodeAddr(m, RESPONSE_ORIGIN)
+}
+
+func (addr *ResponseOrigin) GetFrom(m *Message) error {
+	return (*Addr)(addr).decodeAddr(m, RESPONSE_ORIGIN)
+}
+
+type OtherAddress Addr
+
+func (addr *OtherAddress) AddTo(m *Message) error {
+	return (*Addr)(addr).encodeAddr(m, OTHER_ADDRESS)
+}
+
+func (addr *OtherAddress) GetFrom(m *Message) error {
+	return (*Addr)(addr).decodeAddr(m, OTHER_ADDRESS)
+}
+
+/*
+   Determining NAT Mapping Behavior: RFC 5780 section 4.3
+
+   test I:   Binding request to the primary address, the server returns
+             XOR-MAPPED-ADDRESS and OTHER-ADDRESS.
+   test II:  Binding request to the alternate IP address and the primary port.
+             If XOR-MAPPED-ADDRESS equals test I, the mapping is Endpoint-Independent.
+   test III: Binding request to the alternate address and port.
+             If XOR-MAPPED-ADDRESS equals test II, the mapping is Address-Dependent,
+             otherwise it is Address and Port-Dependent.
+*/
+
+type MappingBehavior int
+
+const (
+	MappingUnknown MappingBehavior = iota
+	MappingEndpointIndependent
+	MappingAddressDependent
+	MappingAddressPortDependent
+)
+
+func (b MappingBehavior) String() string {
+	switch b {
+	case MappingEndpointIndependent:
+		return "endpoint-independent"
+	case MappingAddressDependent:
+		return "address-dependent"
+	case MappingAddressPortDependent:
+		return "address and port-dependent"
+	}
+	return "unknown"
+}
+
+const natTestTimeout = time.Second * 3
+
+// classify the NAT mapping behavior, c must be the client of NewClientPacket
+func (c *Client) DiscoverNATMapping() (MappingBehavior, error) {
+	p, ok := c.conn.(packetConnection)
+	if !ok {
+		return MappingUnknown, errors.New("mapping discovery needs the client of unconnected socket")
+	}
+	primary, ok := p.raddr.(*net.UDPAddr)
+	if !ok {
+		return MappingUnknown, errors.New("mapping discovery needs UDP server address")
+	}
+
+	// test I
+	var other OtherAddress
+	mapped1, err := c.mappedBy(primary, &other)
+	if err != nil {
+		return MappingUnknown, err
+	}
+
+	// test II
+	mapped2, err := c.mappedBy(&net.UDPAddr{IP: other.IP, Port: primary.Port}, nil)
+	if err != nil {
+		return MappingUnknown, err
+	}
+	if sameAddr(mapped1, mapped2) {
+		return MappingEndpointIndependent, nil
+	}
+
+	// test III
+	mapped3, err := c.mappedBy(&net.UDPAddr{IP: other.IP, Port: other.Port}, nil)
+	if err != nil {
+		return MappingUnknown, err
+	}
+	if sameAddr(mapped2, mapped3) {
+		return MappingAddressDependent, nil
+	}
+	return MappingAddressPortDependent, nil
+}
+
+// XOR-MAPPED-ADDRESS of the Binding response of addr, and OTHER-ADDRESS if other is not nil.
+// the response is released after its attributes are read
+func (c *Client) mappedBy(addr net.Addr, other *OtherAddress) (XORMappedAddress, error) {
+	var mapped XORMappedAddress
+	res, err := c.bindingTo(addr)
+	if err != nil {
+		return mapped, err // the error response is kept by *StunError
+	}
+	defer ReleaseMessage(res)
+
+	if err := mapped.GetFrom(res); err != nil {
+		return mapped, err
+	}
+	if other != nil && other.GetFrom(res) != nil {
+		return mapped, errors.New("server does not support RFC 5780: no OTHER-ADDRESS")
+	}
+	return mapped, nil
+}
+
+func sameAddr(a, b XORMappedAddress) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+// send Binding request to addr instead of the server of c.
+// the request is not retransmitted, since the retransmission is sent to the server
+func (c *Client) bindingTo(addr net.Addr) (*Message, error) {
+	m := new(Message)
+	if err := m.Build(TransactionID, BindingRequest); err != nil {
+		return nil, err
+	}
+	if err := c.addConfigured(m); err != nil {
+		return nil, err
+	}
+
+	var (
+		res    *Message
+		resErr error
+	)
+	f := callbackPool.Get().(*CallbackHandle)
+	f.callback = func(e MessageObj) {
+		res, resErr = e.Msg, e.Err
+	}
+	defer func() {
+		f.Reset()
+		callbackPool.Put(f)
+	}()
+
+	if err := c.agent.Start(m.TransactionID, c.clock.Now().Add(natTestTimeout), f, nil); err != nil {
+		return nil, err
+	}
+	if err := c.setRequestType(m); err != nil {
+		f.Wait() // the transaction is already finished
+		return nil, err
+	}
+	if _, err := c.writeMessageTo(m, addr, time.Now().Add(natTestTimeout)); err != nil {
+		c.agent.CancelHandle(m.TransactionID, err)
+		f.Wait()
+		return nil, err
+	}
+	c.logEvent(LogEvent{Kind: LogRequestSent, ID: m.TransactionID, Type: m.Type})
+	f.Wait()
+
+	if resErr != nil {
+		return nil, resErr
+	}
+	return res, responseError(res)
+}
@@ -0,0 +1,124 @@
+package gostun
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fake RFC 5780 server, the primary address and the other address of the different IP.
+// the mapped port of each address of the server is the port of mapped
+type fakeNATServer struct {
+	primary   net.PacketConn
+	alternate net.PacketConn // the primary port on the other IP
+	other     net.PacketConn // the other address
+}
+
+func listenNATServer(t *testing.T, mapped [3]int) *fakeNATServer {
+	t.Helper()
+	primary, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := primary.LocalAddr().(*net.UDPAddr).Port
+	alternate, err := net.ListenPacket("udp4", net.JoinHostPort("127.0.0.2", strconv.Itoa(port)))
+	if err != nil {
+		primary.Close()
+		t.Skip("no second loopback address:", err)
+	}
+	other, err := net.ListenPacket("udp4", "127.0.0.2:0")
+	if err != nil {
+		primary.Close()
+		alternate.Close()
+		t.Skip("no second loopback address:", err)
+	}
+	s := &fakeNATServer{primary: primary, alternate: alternate, other: other}
+	t.Cleanup(func() {
+		primary.Close()
+		alternate.Close()
+		other.Close()
+	})
+	otherAddr := other.LocalAddr().(*net.UDPAddr)
+	for i, pc := range []net.PacketConn{primary, alternate, other} {
+		go serveNAT(pc, mapped[i], otherAddr)
+	}
+	return s
+}
+
+// answer Binding requests with XOR-MAPPED-ADDRESS of port and OTHER-ADDRESS of other
+func serveNAT(pc net.PacketConn, port int, other *net.UDPAddr) {
+	buf := make([]byte, defaultMaxMessageSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := &Message{Raw: buf[:n]}
+		if req.Decode() != nil || req.Type != BindingRequest {
+			continue
+		}
+		res := &Message{TransactionID: req.TransactionID}
+		if res.Build(BindingSuccess,
+			&XORMappedAddress{IP: net.IPv4(203, 0, 113, 1), Port: port},
+			&OtherAddress{IP: other.IP, Port: other.Port}) != nil {
+			return
+		}
+		pc.WriteTo(res.Raw, addr)
+	}
+}
+
+func TestDiscoverNATMapping(t *testing.T) {
+	for _, tc := range []struct {
+		mapped [3]int // mapped ports of test I, II and III
+		want   MappingBehavior
+	}{
+		{[3]int{1000, 1000, 1000}, MappingEndpointIndependent},
+		{[3]int{1000, 2000, 2000}, MappingAddressDependent},
+		{[3]int{1000, 2000, 3000}, MappingAddressPortDependent},
+	} {
+		s := listenNATServer(t, tc.mapped)
+		pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewClientPacket(pc, s.primary.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.DiscoverNATMapping()
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Fatalf("mapping of %v is %s, want %s", tc.mapped, got, tc.want)
+		}
+	}
+}
+
+// the server without OTHER-ADDRESS is not RFC 5780
+func TestDiscoverNATMappingNoOther(t *testing.T) {
+	a, b := Pipe()
+	defer b.Close()
+	c, err := NewClientPacket(a, b.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.DiscoverNATMapping()
+		done <- err
+	}()
+	req := readRequest(t, b)
+	b.Write(response(t, req, BindingSuccess, &XORMappedAddress{IP: net.IPv4(203, 0, 113, 1), Port: 1000}))
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("no error without OTHER-ADDRESS")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("DiscoverNATMapping is not returned")
+	}
+}
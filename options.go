@@ -0,0 +1,164 @@
+package gostun
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// configures the client before its loops are started by NewClient, NewClientPacket and Dial
+type Option func(c *Client) error
+
+func (c *Client) apply(opts []Option) error {
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interval of the timeout and retransmission sweep
+func WithTimeoutRate(d time.Duration) Option {
+	return func(c *Client) error {
+		if d <= 0 {
+			err := fmt.Sprintf("timeout rate(%s) is not positive", d)
+			return errors.New(err)
+		}
+		c.TimeoutRate = d
+		return nil
+	}
+}
+
+// initial RTO of the server which is not cached
+func WithRTO(d time.Duration) Option {
+	return func(c *Client) error {
+		if d <= 0 {
+			err := fmt.Sprintf("RTO(%s) is not positive", d)
+			return errors.New(err)
+		}
+		c.RTO = d
+		return nil
+	}
+}
+
+// Rc, count of the requests including the first one, 0 disables retransmission
+func WithMaxRetries(n int) Option {
+	return func(c *Client) error {
+		if n < 0 {
+			err := fmt.Sprintf("max retries(%d) is negative", n)
+			return errors.New(err)
+		}
+		c.MaxRetries = n
+		return nil
+	}
+}
+
+// SOFTWARE of requests and indications
+func WithSoftware(s string) Option {
+	return func(c *Client) error {
+		if len(s) > maxSoftware {
+			err := fmt.Sprintf("SOFTWARE length(%d) is more than %d", len(s), maxSoftware)
+			return errors.New(err)
+		}
+		c.Software = s
+		return nil
+	}
+}
+
+// size of the read buffer of datagrams
+func WithMaxMessageSize(n int) Option {
+	return func(c *Client) error {
+		if n < messageHeader {
+			err := fmt.Sprintf("max message size(%d) is less than header size(%d)", n, messageHeader)
+			return errors.New(err)
+		}
+		c.MaxMessageSize = n
+		return nil
+	}
+}
+
+// the messages larger than n are logged as LogOversize, 0 disables it
+func WithMTU(n int) Option {
+	return func(c *Client) error {
+		if n < 0 {
+			err := fmt.Sprintf("MTU(%d) is negative", n)
+			return errors.New(err)
+		}
+		c.MTU = n
+		return nil
+	}
+}
+
+// overrides the transport mode detected from conn, reliable messages are framed
+// and not retransmitted
+func WithReliable(reliable bool) Option {
+	return func(c *Client) error {
+		c.Reliable = reliable
+		return nil
+	}
+}
+
+func WithLogger(l Logger) Option {
+	return func(c *Client) error {
+		c.SetLogger(l)
+		return nil
+	}
+}
+
+func WithMetrics(m Metrics) Option {
+	return func(c *Client) error {
+		c.SetMetrics(m)
+		return nil
+	}
+}
+
+// requests and indications are signed by MESSAGE-INTEGRITY of the short-term credential pw
+func WithShortTermAuth(pw string) Option {
+	return func(c *Client) error {
+		if pw == "" {
+			return errors.New("short-term password is empty")
+		}
+		c.integrity = NewShortTermIntegrity(pw)
+		return nil
+	}
+}
+
+// FINGERPRINT is added to requests and indications as the last attribute
+func WithFingerprint() Option {
+	return func(c *Client) error {
+		c.AddFingerprint = true
+		return nil
+	}
+}
+
+// messages without valid FINGERPRINT are dropped before they are processed
+func WithRequireFingerprint() Option {
+	return func(c *Client) error {
+		c.RequireFingerprint = true
+		return nil
+	}
+}
+
+// max count of the in-flight transactions, 0 is unlimited
+func WithMaxTransactions(n int) Option {
+	return func(c *Client) error {
+		if n < 0 {
+			err := fmt.Sprintf("max transactions(%d) is negative", n)
+			return errors.New(err)
+		}
+		c.SetMaxTransactions(n)
+		return nil
+	}
+}
+
+// clock of the transactions of the client and its agent, e.g. FakeClock in tests
+func WithClock(clk Clock) Option {
+	return func(c *Client) error {
+		if clk == nil {
+			return errors.New("clock is nil")
+		}
+		c.setClock(clk)
+		return nil
+	}
+}
@@ -0,0 +1,156 @@
+package gostun
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+   PASSWORD-ALGORITHMS: RFC 8489 section 14.11
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |         Algorithm 1           | Algorithm 1 Parameters Length |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |                    Algorithm 1 Parameters (variable)
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |         Algorithm 2           | Algorithm 2 Parameters Length |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |                    Algorithm 2 Parameters (variable)
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |                             ...
+
+   PASSWORD-ALGORITHM (RFC 8489 section 14.12) is one of them, which the
+   client selected.  The long-term key is the hash of the algorithm:
+   key = H(username ":" realm ":" OpaqueString(password))
+*/
+
+type PasswordAlgorithm uint16
+
+const (
+	PasswordAlgorithmMD5    PasswordAlgorithm = 0x0001
+	PasswordAlgorithmSHA256 PasswordAlgorithm = 0x0002
+)
+
+const passwordAlgorithmHeader = 4 // algorithm and parameters length
+
+var passwordAlgorithmName = map[PasswordAlgorithm]string{
+	PasswordAlgorithmMD5:    "MD5",
+	PasswordAlgorithmSHA256: "SHA-256",
+}
+
+func (a PasswordAlgorithm) String() string {
+	if s, ok := passwordAlgorithmName[a]; ok {
+		return s
+	}
+	return fmt.Sprintf("0x%04x", uint16(a))
+}
+
+// long-term key of the algorithm, MD5 and SHA-256 have no parameters
+func (a PasswordAlgorithm) key(username, realm, password string) ([]byte, error) {
+	k := []byte(strings.Join([]string{username, realm, password}, ":"))
+	switch a {
+	case PasswordAlgorithmMD5:
+		h := md5.Sum(k)
+		return h[:], nil
+	case PasswordAlgorithmSHA256:
+		h := sha256.Sum256(k)
+		return h[:], nil
+	}
+	err := fmt.Sprintf("unsupported password algorithm: %s", a)
+	return nil, errors.New(err)
+}
+
+func (a PasswordAlgorithm) AddTo(m *Message) error {
+	return m.Add(PASSWORD_ALGORITHM, encodePasswordAlgorithms([]PasswordAlgorithm{a}))
+}
+
+func (a *PasswordAlgorithm) GetFrom(m *Message) error {
+	v, err := m.GetRapped(PASSWORD_ALGORITHM)
+	if err != nil {
+		return err
+	}
+	algs, err := decodePasswordAlgorithms(v)
+	if err != nil {
+		return err
+	}
+	if len(algs) != 1 {
+		err := fmt.Sprintf("PASSWORD-ALGORITHM has %d algorithms", len(algs))
+		return errors.New(err)
+	}
+	*a = algs[0]
+	return nil
+}
+
+// algorithms which the server supports, in the order of its preference
+type PasswordAlgorithms []PasswordAlgorithm
+
+func (p PasswordAlgorithms) AddTo(m *Message) error {
+	return m.Add(PASSWORD_ALGORITHMS, encodePasswordAlgorithms(p))
+}
+
+func (p *PasswordAlgorithms) GetFrom(m *Message) error {
+	v, err := m.GetRapped(PASSWORD_ALGORITHMS)
+	if err != nil {
+		return err
+	}
+	algs, err := decodePasswordAlgorithms(v)
+	if err != nil {
+		return err
+	}
+	*p = algs
+	return nil
+}
+
+// the algorithm which the client selects, SHA-256 is preferred to MD5
+func (p PasswordAlgorithms) selected() (PasswordAlgorithm, bool) {
+	md5 := false
+	for _, a := range p {
+		switch a {
+		case PasswordAlgorithmSHA256:
+			return a, true
+		case PasswordAlgorithmMD5:
+			md5 = true
+		}
+	}
+	return PasswordAlgorithmMD5, md5
+}
+
+func encodePasswordAlgorithms(algs []PasswordAlgorithm) []byte {
+	v := make([]byte, passwordAlgorithmHeader*len(algs))
+	for i, a := range algs {
+		putU16(v, passwordAlgorithmHeader*i, uint16(a))
+		// parameters length is 0
+	}
+	return v
+}
+
+// parameters are skipped, since MD5 and SHA-256 have no parameters
+func decodePasswordAlgorithms(v []byte) ([]PasswordAlgorithm, error) {
+	var algs []PasswordAlgorithm
+	for len(v) > 0 {
+		if len(v) < passwordAlgorithmHeader {
+			err := fmt.Sprintf("password algorithm length(%d) is less than %d", len(v), passwordAlgorithmHeader)
+			return nil, errors.New(err)
+		}
+		a, err := getU16(v, 0)
+		if err != nil {
+			return nil, err
+		}
+		pl, err := getU16(v, 2)
+		if err != nil {
+			return nil, err
+		}
+		l := paddingLength(int(pl))
+		if len(v[passwordAlgorithmHeader:]) < l {
+			err := fmt.Sprintf("password algorithm parameters length(%d) is more than %d", l, len(v[passwordAlgorithmHeader:]))
+			return nil, errors.New(err)
+		}
+		algs = append(algs, PasswordAlgorithm(a))
+		v = v[passwordAlgorithmHeader+l:]
+	}
+	return algs, nil
+}
@@ -0,0 +1,52 @@
+package gostun
+
+import "sync"
+
+/*
+   Ownership of the Message of the read loop:
+   the read loop acquires a Message for each packet and passes it to
+   ProcessHandle.  The handler of the transaction (or the handler of
+   non-registered transactions) owns MessageObj.Msg, and may keep it or
+   call ReleaseMessage when it is done.  If no handler is called,
+   ProcessHandle releases the Message itself.
+   A released Message MUST NOT be used, since it is reused by the next read,
+   so use Message.Clone to keep a Message which may be released by others.
+*/
+
+const defaultRawSize = 1024
+
+var messagePool = sync.Pool{
+	New: func() interface{} {
+		return &Message{
+			Raw: make([]byte, 0, defaultRawSize),
+		}
+	},
+}
+
+// returns empty Message from pool
+func AcquireMessage() *Message {
+	return messagePool.Get().(*Message)
+}
+
+// reset m and put it to pool
+func ReleaseMessage(m *Message) {
+	m.Reset()
+	messagePool.Put(m)
+}
+
+// clear the fields of m, m.Raw is truncated to be reused
+func (m *Message) Reset() {
+	m.Raw = m.Raw[:0]
+	m.Type = MessageType{}
+	m.Length = 0
+	m.TransactionID = [TransactionIDSize]byte{}
+	m.Attributes = m.Attributes[:0]
+}
+
+// extend m.Raw to n bytes for reading, the contents are kept
+func (m *Message) grow(n int) {
+	if cap(m.Raw) < n {
+		m.Raw = append(m.Raw[:cap(m.Raw)], make([]byte, n-cap(m.Raw))...)
+	}
+	m.Raw = m.Raw[:n]
+}
@@ -0,0 +1,51 @@
+package gostun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+/*
+   On the shared socket of ICE, the client sends its connectivity checks
+   and also answers the checks of the peer.  The handler of SetRequestHandler is
+   called with MessageObj.Respond, which sends the response to the source
+   address of the request, so the handler can answer it inline.
+*/
+
+// Handler of SetRequestHandler, which sets Respond of the events
+type responder struct {
+	c *Client
+	h Handler
+}
+
+func (r responder) HandleEvent(e MessageObj) {
+	from := e.From
+	e.Respond = func(m *Message) error {
+		return r.c.respond(m, from)
+	}
+	r.h.HandleEvent(e)
+}
+
+// send the response m to addr, FINGERPRINT is added if AddFingerprint.
+// MESSAGE-INTEGRITY is not added, since the response is signed with the local password of ICE
+func (c *Client) respond(m *Message, addr net.Addr) error {
+	if !m.IsResponse() {
+		err := fmt.Sprintf("message class %s is not response", m.Type.Class)
+		return errors.New(err)
+	}
+	if len(m.Raw) < messageHeader {
+		m.Encode()
+	}
+	if c.AddFingerprint && !m.hasFingerprint() {
+		if err := FingerprintAttr.AddTo(m); err != nil {
+			return err
+		}
+	}
+	if _, err := c.writeMessageTo(m, addr, time.Time{}); err != nil {
+		return err
+	}
+	c.logEvent(LogEvent{Kind: LogResponseSent, ID: m.TransactionID, Type: m.Type})
+	return nil
+}
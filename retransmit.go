@@ -0,0 +1,245 @@
+package gostun
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+   Retransmissions continue until a response is received, or until a total of Rc
+   requests have been sent.  Rc SHOULD be configurable and SHOULD have a default of 7.
+   If, after the last request, a duration equal to Rm times the RTO has passed
+   without a response (providing ample time to get a response if only
+   this final request actually succeeds), the client SHOULD consider the
+   transaction to have failed.
+
+   For example, assuming an RTO of 500 ms, requests would be sent at times 0 ms,
+   500 ms, 1500 ms, 3500 ms, 7500 ms, 15500 ms, and 31500 ms.
+*/
+
+const (
+	defaultRTO        = time.Millisecond * 500
+	defaultMaxRetries = 7 // Rc, count of the requests including the first one
+
+	// Rm, the last request waits Rm times the initial RTO
+	lastRTOMultiplier = 16
+
+	// the transaction fails after 39.5 seconds with the default RTO (Rc=7, Rm=16)
+	defaultTransactionTimeout = time.Millisecond * 39500
+)
+
+// retransmit schedule of the transaction
+type retransmission struct {
+	raw     []byte        // request to be re-sent
+	initial time.Duration // RTO of the first request
+	rto     time.Duration // current interval, doubled by each retransmission
+	next    time.Time     // time of the next retransmission, or the deadline after the last request
+	retries int           // count of retransmissions
+	max     int           // Rc, count of the requests including the first one
+}
+
+// the last request is sent, no more retransmissions
+func (r *retransmission) last() bool {
+	return r.retries >= r.max-1
+}
+
+// exhausted reports the wait after the last request is passed
+func (r *retransmission) exhausted(t time.Time) bool {
+	return r.last() && r.next.Before(t)
+}
+
+// start the retransmit schedule of registered transaction id, raw is copied.
+// max is Rc, the count of the requests including the first one which is already sent
+func (a *Agent) ScheduleHandle(id [TransactionIDSize]byte, raw []byte, rto time.Duration, max int) error {
+	now := a.now()
+	s := a.shard(id)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.closed {
+		return ErrAgent
+	}
+
+	tr, ok := s.transactions[id]
+	if !ok {
+		return ErrTransactionNotExists
+	}
+	r := &retransmission{
+		raw:     append([]byte(nil), raw...),
+		initial: rto,
+		rto:     rto,
+		max:     max,
+	}
+	tr.retransmit = r
+	s.transactions[id] = tr
+	if r.last() {
+		r.next = now.Add(lastRTOMultiplier * rto)
+		s.deadlines.push(r.next, id)
+	} else {
+		r.next = now.Add(rto)
+		s.retransmits.push(r.next, id)
+	}
+
+	return nil
+}
+
+// returns the requests which should be re-sent at trate, and schedules the next one
+func (a *Agent) RetransmitHandle(trate time.Time) ([][]byte, error) {
+	a.mux.RLock()
+	closed := a.closed
+	a.mux.RUnlock()
+	if closed {
+		return nil, ErrAgent
+	}
+
+	var raws [][]byte
+	for _, s := range a.shards {
+		s.mux.Lock()
+		for {
+			t, ok := s.retransmits.popBefore(trate)
+			if !ok {
+				break
+			}
+			tr, ok := s.transactions[t.id]
+			if !ok || tr.retransmit == nil {
+				continue // finished transaction
+			}
+			r := tr.retransmit
+			if r.last() || !r.next.Equal(t.at) {
+				continue // old entry of the transaction
+			}
+			raws = append(raws, r.raw)
+			r.retries++
+			if r.last() {
+				r.next = trate.Add(lastRTOMultiplier * r.initial)
+				s.deadlines.push(r.next, t.id) // exhausted after Rm times the initial RTO
+			} else {
+				r.rto *= 2
+				r.next = trate.Add(r.rto)
+				s.retransmits.push(r.next, t.id)
+			}
+		}
+		s.mux.Unlock()
+	}
+
+	return raws, nil
+}
+
+/*
+The value for RTO SHOULD be cached by a client after the completion
+of the transaction, and used as the starting value for RTO for the
+next transaction to the same server (based on equality of IP
+address).
+
+RTO is computed from the round-trip times as RFC 6298 section 2,
+the first measurement R sets SRTT = R and RTTVAR = R/2, the next ones
+
+   RTTVAR <- (1 - beta) * RTTVAR + beta * |SRTT - R'|
+   SRTT <- (1 - alpha) * SRTT + alpha * R'
+
+with alpha = 1/8 and beta = 1/4, and RTO = SRTT + 4 * RTTVAR.
+*/
+
+// round-trip time estimate of the server
+type rttEstimate struct {
+	srtt   time.Duration
+	rttvar time.Duration
+}
+
+// RTO of the estimate, it is not less than defaultRTO
+func (e rttEstimate) rto() time.Duration {
+	rto := e.srtt + 4*e.rttvar
+	if rto < defaultRTO {
+		return defaultRTO
+	}
+	return rto
+}
+
+// rtoCache is RTO of each server IP
+type rtoCache struct {
+	mux sync.RWMutex
+	rtt map[string]rttEstimate
+}
+
+func newRTOCache() *rtoCache {
+	return &rtoCache{
+		rtt: make(map[string]rttEstimate),
+	}
+}
+
+func (r *rtoCache) Get(ip net.IP) (time.Duration, bool) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	e, ok := r.rtt[ip.String()]
+	if !ok {
+		return 0, false
+	}
+	return e.rto(), true
+}
+
+// update the estimate of ip by the round-trip time of the transaction
+func (r *rtoCache) Sample(ip net.IP, rtt time.Duration) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	e, ok := r.rtt[ip.String()]
+	if !ok {
+		e = rttEstimate{srtt: rtt, rttvar: rtt / 2}
+	} else {
+		diff := e.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		e.rttvar = (3*e.rttvar + diff) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+	r.rtt[ip.String()] = e
+}
+
+// remoteAddr returns address of the server, nil if conn has no remote address
+func remoteAddr(conn Connection) net.Addr {
+	c, ok := conn.(interface {
+		RemoteAddr() net.Addr
+	})
+	if !ok {
+		return nil
+	}
+	return c.RemoteAddr()
+}
+
+// remoteIP returns IP address of the server, nil if conn has no remote address
+func remoteIP(conn Connection) net.IP {
+	switch addr := remoteAddr(conn).(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// returns the cached RTO of ip, which is computed from the round-trip times of the transactions
+func (c *Client) CachedRTO(ip net.IP) (time.Duration, bool) {
+	return c.rtoCache.Get(ip)
+}
+
+// initial RTO of the next transaction
+func (c *Client) startRTO() time.Duration {
+	if ip := remoteIP(c.conn); ip != nil {
+		if rto, ok := c.rtoCache.Get(ip); ok {
+			return rto
+		}
+	}
+	return c.RTO
+}
+
+// update the cached RTO by the round-trip time of the completed transaction,
+// zero rtt of the retransmitted transaction is not sampled (Karn's rule)
+func (c *Client) cacheRTO(rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	if ip := remoteIP(c.conn); ip != nil {
+		c.rtoCache.Sample(ip, rtt)
+	}
+}
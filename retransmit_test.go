@@ -0,0 +1,151 @@
+package gostun
+
+import (
+	"testing"
+	"time"
+)
+
+// the ticks are late by 1ms at most, like the sweep of timeoutUntil
+const scheduleTolerance = time.Millisecond * 10
+
+func near(got, want time.Duration) bool {
+	return got >= want && got <= want+scheduleTolerance
+}
+
+// RFC 5389 section 7.2.1: requests at 0, 500, 1500, 3500, 7500, 15500 and 31500 ms,
+// and the transaction fails at 39500 ms
+func TestRetransmitSchedule(t *testing.T) {
+	a := NewAgent()
+	start := time.Unix(1000, 0)
+	clk := NewFakeClock(start)
+	a.SetClock(clk)
+	h := make(eventHandler, 1)
+	id := [TransactionIDSize]byte{1}
+	if err := a.Start(id, time.Time{}, h, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ScheduleHandle(id, []byte{1}, defaultRTO, defaultMaxRetries); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent []time.Duration
+	for at := time.Duration(0); at <= time.Second*45; at += time.Millisecond {
+		now := start.Add(at)
+		raws, err := a.RetransmitHandle(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range raws {
+			sent = append(sent, at)
+		}
+		if err := a.TimeOutHandle(now); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case e := <-h:
+			if e.Err != TransactionTimeOutErr {
+				t.Fatalf("err is %v", e.Err)
+			}
+			if !near(at, defaultTransactionTimeout) {
+				t.Fatalf("failed at %s, want %s", at, defaultTransactionTimeout)
+			}
+			want := []time.Duration{500, 1500, 3500, 7500, 15500, 31500}
+			if len(sent) != len(want) {
+				t.Fatalf("retransmissions at %v, want %v ms", sent, want)
+			}
+			for i, w := range want {
+				if !near(sent[i], w*time.Millisecond) {
+					t.Fatalf("retransmissions at %v, want %v ms", sent, want)
+				}
+			}
+			return
+		default:
+		}
+	}
+	t.Fatal("transaction is not failed")
+}
+
+// a single request waits Rm times RTO
+func TestRetransmitSingleRequest(t *testing.T) {
+	a := NewAgent()
+	start := time.Unix(1000, 0)
+	a.SetClock(NewFakeClock(start))
+	h := make(eventHandler, 1)
+	id := [TransactionIDSize]byte{1}
+	a.Start(id, time.Time{}, h, nil)
+	a.ScheduleHandle(id, []byte{1}, time.Second, 1)
+
+	if raws, _ := a.RetransmitHandle(start.Add(time.Second * 10)); len(raws) != 0 {
+		t.Fatalf("%d retransmissions", len(raws))
+	}
+	a.TimeOutHandle(start.Add(time.Second * 15))
+	h.none(t)
+	a.TimeOutHandle(start.Add(time.Second*16 + 1))
+	if e := h.next(t); e.Err != TransactionTimeOutErr {
+		t.Fatalf("err is %v", e.Err)
+	}
+}
+
+// RFC 6298 section 2.2 and 2.3, the RTO is not less than defaultRTO
+func TestRTOCacheSample(t *testing.T) {
+	r := newRTOCache()
+	ip := []byte{192, 0, 2, 1}
+	if _, ok := r.Get(ip); ok {
+		t.Fatal("RTO of the unknown server")
+	}
+	for _, tc := range []struct {
+		rtt, rto time.Duration
+	}{
+		{time.Millisecond * 400, time.Millisecond * 1200}, // SRTT 400, RTTVAR 200
+		{time.Millisecond * 800, time.Millisecond * 1450}, // SRTT 450, RTTVAR 250
+		{time.Millisecond * 10, time.Millisecond * 1585},  // SRTT 395, RTTVAR 297.5
+	} {
+		r.Sample(ip, tc.rtt)
+		if rto, ok := r.Get(ip); !ok || rto != tc.rto {
+			t.Fatalf("RTO after %s is %s, want %s", tc.rtt, rto, tc.rto)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		r.Sample(ip, time.Millisecond)
+	}
+	if rto, _ := r.Get(ip); rto != defaultRTO {
+		t.Fatalf("RTO of the short round-trips is %s, want %s", rto, defaultRTO)
+	}
+}
+
+// the round-trip time of the retransmitted transaction is ambiguous (Karn's rule)
+func TestRetransmittedRTT(t *testing.T) {
+	a := NewAgent()
+	defer a.Close()
+	start := time.Unix(1000, 0)
+	clk := NewFakeClock(start)
+	a.SetClock(clk)
+	h := make(eventHandler, 2)
+	for i, retransmit := range []bool{false, true} {
+		id := [TransactionIDSize]byte{byte(i)}
+		if err := a.Start(id, time.Time{}, h, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.ScheduleHandle(id, []byte{1}, defaultRTO, defaultMaxRetries); err != nil {
+			t.Fatal(err)
+		}
+		clk.Advance(defaultRTO + time.Millisecond)
+		if retransmit {
+			if raws, _ := a.RetransmitHandle(clk.Now()); len(raws) != 1 {
+				t.Fatalf("%d retransmissions, want 1", len(raws))
+			}
+		}
+		m := &Message{TransactionID: id}
+		if err := m.Build(BindingSuccess); err != nil {
+			t.Fatal(err)
+		}
+		a.ProcessHandle(m, nil)
+		e := h.next(t)
+		if retransmit && e.RTT != 0 {
+			t.Fatalf("RTT of retransmitted transaction is %s", e.RTT)
+		}
+		if !retransmit && e.RTT != defaultRTO+time.Millisecond {
+			t.Fatalf("RTT is %s, want %s", e.RTT, defaultRTO+time.Millisecond)
+		}
+	}
+}
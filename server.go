@@ -0,0 +1,245 @@
+package gostun
+
+import (
+	"net"
+	"sync"
+)
+
+// handles the request req from addr, and returns the response.
+// nil response means nothing is sent, e.g. for indications.
+// req is released after ServeSTUN, so it must not be kept
+type ServerHandler interface {
+	ServeSTUN(req *Message, from net.Addr) *Message
+}
+
+// reference http.HandlerFunc same work
+type ServerHandlerFunc func(req *Message, from net.Addr) *Message
+
+func (f ServerHandlerFunc) ServeSTUN(req *Message, from net.Addr) *Message {
+	return f(req, from)
+}
+
+// Ethernet MTU, the requests of the clients are not limited to the IPv6 minimum MTU
+const defaultServerMessageSize = 1500
+
+// STUN server of unconnected socket
+type Server struct {
+	MaxMessageSize int // size of the read buffer, set before Serve
+	conn           net.PacketConn
+	mux            sync.RWMutex // guards handlers, integrity and logger
+	handlers       map[Method]ServerHandler
+	integrity      MessageIntegrity // short-term credential, nil accepts messages without it
+	logger         Logger
+}
+
+// returns server which responds to Binding requests, call Serve to read requests
+func NewServer(pc net.PacketConn) *Server {
+	return &Server{
+		MaxMessageSize: defaultServerMessageSize,
+		conn:           pc,
+		handlers: map[Method]ServerHandler{
+			MethodBinding: ServerHandlerFunc(ServeBinding),
+		},
+	}
+}
+
+// register h for the messages of method
+func (s *Server) Handle(method Method, h ServerHandler) {
+	s.mux.Lock()
+	s.handlers[method] = h
+	s.mux.Unlock()
+}
+
+// messages must have USERNAME and MESSAGE-INTEGRITY of pw, e.g. ICE connectivity checks.
+// the responses are signed with pw, an empty pw disables the verification
+func (s *Server) SetShortTermPassword(pw string) {
+	s.mux.Lock()
+	if pw == "" {
+		s.integrity = nil
+	} else {
+		s.integrity = NewShortTermIntegrity(pw)
+	}
+	s.mux.Unlock()
+}
+
+// read and process messages until the conn is closed
+func (s *Server) Serve() error {
+	for {
+		m := AcquireMessage()
+		m.grow(s.MaxMessageSize)
+		n, addr, err := s.conn.ReadFrom(m.Raw)
+		if err != nil {
+			ReleaseMessage(m)
+			return err
+		}
+		full := n == len(m.Raw)
+		m.Raw = m.Raw[:n]
+		if full && m.truncated() {
+			ReleaseMessage(m)
+			s.logEvent(LogEvent{Kind: LogDecodeError, From: addr, Err: ErrMessageTruncated})
+			continue
+		}
+		if err := m.Decode(); err != nil {
+			ReleaseMessage(m)
+			s.logEvent(LogEvent{Kind: LogDecodeError, From: addr, Err: err})
+			continue
+		}
+		s.serve(m, addr)
+		ReleaseMessage(m)
+	}
+}
+
+func (s *Server) Close() error {
+	return s.conn.Close()
+}
+
+func (s *Server) serve(req *Message, from net.Addr) {
+	if req.IsResponse() {
+		return // server does not send requests
+	}
+
+	s.mux.RLock()
+	h, ok := s.handlers[req.Method()]
+	integrity := s.integrity
+	s.mux.RUnlock()
+
+	// the credential is checked before the attributes, RFC 5389 section 10.1.2
+	if integrity != nil {
+		if code := checkShortTerm(req, integrity); code != 0 {
+			if req.IsRequest() {
+				s.write(s.errorResponse(req, code), from)
+			}
+			return // indication is discarded
+		}
+	}
+
+	var res *Message
+	// RFC 5389 section 7.3.1, 7.3.2: unknown comprehension-required attributes
+	unknown := req.ForEachUnknown(isKnownAttr)
+	switch {
+	case len(unknown) > 0:
+		if req.IsRequest() {
+			res = s.unknownResponse(req, unknown)
+		}
+	case ok:
+		res = h.ServeSTUN(req, from)
+	case req.IsRequest():
+		res = s.errorResponse(req, CodeBadRequest)
+	}
+	if res == nil {
+		return // nothing is sent
+	}
+	if integrity != nil {
+		if err := signResponse(res, req, integrity); err != nil {
+			s.logEvent(LogEvent{Kind: LogEncodeError, ID: req.TransactionID, Type: res.Type, Err: err})
+			res = s.errorResponse(req, CodeServerError)
+		}
+	}
+	s.write(res, from)
+}
+
+// RFC 5389 section 10.1.2: returns error code of req, 0 if req is authenticated by i
+func checkShortTerm(req *Message, i MessageIntegrity) int {
+	if _, ok := req.Get(USERNAME); !ok {
+		return CodeBadRequest
+	}
+	if _, ok := req.Get(MESSAGE_INTEGRITY); !ok {
+		return CodeBadRequest
+	}
+	if err := i.Check(req); err != nil {
+		return CodeUnauthorized
+	}
+	return 0
+}
+
+// add MESSAGE-INTEGRITY of i to res, and FINGERPRINT if req has it.
+// res which is already signed by the handler is not changed
+func signResponse(res, req *Message, i MessageIntegrity) error {
+	if res.hasIntegrity() || res.hasFingerprint() {
+		return nil
+	}
+	if err := i.AddTo(res); err != nil {
+		return err
+	}
+	if req.hasFingerprint() {
+		return FingerprintAttr.AddTo(res)
+	}
+	return nil
+}
+
+func (s *Server) write(res *Message, to net.Addr) {
+	if _, err := s.conn.WriteTo(res.Raw, to); err != nil {
+		s.logEvent(LogEvent{Kind: LogWriteError, ID: res.TransactionID, From: to, Err: err})
+	}
+}
+
+// returns the error response of req, the error of ERROR-CODE is logged
+func (s *Server) errorResponse(req *Message, code int) *Message {
+	res, err := newErrorResponse(req, code)
+	if err != nil {
+		s.logEvent(LogEvent{Kind: LogEncodeError, ID: req.TransactionID, Type: res.Type, Err: err})
+	}
+	return res
+}
+
+// returns 420 Unknown Attribute of req, the error of UNKNOWN-ATTRIBUTES is logged
+func (s *Server) unknownResponse(req *Message, unknown []AttributeType) *Message {
+	res, err := newUnknownResponse(req, unknown)
+	if err != nil {
+		s.logEvent(LogEvent{Kind: LogEncodeError, ID: req.TransactionID, Type: res.Type, Err: err})
+	}
+	return res
+}
+
+// returns the response of req with the same method and transaction id
+func newResponse(req *Message, class MessageClass) *Message {
+	res := &Message{
+		Type:          NewMessageType(req.Method(), class),
+		TransactionID: req.TransactionID,
+	}
+	res.Encode()
+	return res
+}
+
+// returns the error response of req with ERROR-CODE of code.
+// the response is returned with the error too, without ERROR-CODE
+func newErrorResponse(req *Message, code int) (*Message, error) {
+	res := newResponse(req, ClassErrorResponse)
+	e := &ErrorCodeAttribute{
+		Code:   code,
+		Reason: ErrorReason[code],
+	}
+	return res, e.AddTo(res)
+}
+
+// returns 420 Unknown Attribute with UNKNOWN-ATTRIBUTES of unknown
+func newUnknownResponse(req *Message, unknown []AttributeType) (*Message, error) {
+	res, err := newErrorResponse(req, CodeUnknownAttribute)
+	if err != nil {
+		return res, err
+	}
+	return res, UnknownAttributes(unknown).AddTo(res)
+}
+
+// respond to Binding request with XOR-MAPPED-ADDRESS of the source address
+func ServeBinding(req *Message, from net.Addr) *Message {
+	if !req.IsRequest() {
+		return nil // Binding indication is a keepalive
+	}
+
+	addr, ok := from.(*net.UDPAddr)
+	if !ok {
+		res, _ := newErrorResponse(req, CodeServerError) // ERROR-CODE of 500 is always valid
+		return res
+	}
+	res := newResponse(req, ClassSuccessResponse)
+	xor := &XORMappedAddress{
+		IP:   addr.IP,
+		Port: addr.Port,
+	}
+	if err := xor.AddTo(res); err != nil {
+		res, _ := newErrorResponse(req, CodeServerError) // ERROR-CODE of 500 is always valid
+		return res
+	}
+	return res
+}
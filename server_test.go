@@ -0,0 +1,94 @@
+package gostun
+
+import (
+	"testing"
+	"time"
+)
+
+// server of the returned client by Pipe, closed at the end of the test
+func testServer(t *testing.T) (*Server, *Client) {
+	t.Helper()
+	a, b := Pipe()
+	s := NewServer(a)
+	c, err := NewClient(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return s, c
+}
+
+// send m to the server of c, and returns the error of the response
+func serverError(t *testing.T, c *Client, m *Message) error {
+	t.Helper()
+	res, err := c.Do(m, time.Now().Add(time.Second*5))
+	if res != nil {
+		ReleaseMessage(res)
+	}
+	return err
+}
+
+// the request of the method without handler is 400 Bad Request
+func TestServerBadRequest(t *testing.T) {
+	s, c := testServer(t)
+	go s.Serve()
+	err := serverError(t, c, MessageBuild(TransactionID, NewMessageType(MethodAllocate, ClassRequest)))
+	if !IsBadRequest(err) {
+		t.Fatalf("err is %v, want 400", err)
+	}
+}
+
+// the request without USERNAME is 400, and the one of another password is 401 Unauthorized
+func TestServerShortTermAuth(t *testing.T) {
+	s, c := testServer(t)
+	s.SetShortTermPassword("password")
+	go s.Serve()
+	if err := serverError(t, c, MessageBuild(TransactionID, BindingRequest)); !IsBadRequest(err) {
+		t.Fatalf("err without USERNAME is %v, want 400", err)
+	}
+	m := MessageBuild(TransactionID, BindingRequest, Username("user"), NewShortTermIntegrity("other"))
+	if err := serverError(t, c, m); !IsUnauthorized(err) {
+		t.Fatalf("err of another password is %v, want 401", err)
+	}
+}
+
+// the comprehension-required attribute which the server doesn't know is 420 with UNKNOWN-ATTRIBUTES
+func TestServerUnknownAttribute(t *testing.T) {
+	s, c := testServer(t)
+	go s.Serve()
+	const unknown = AttributeType(0x7fff)
+	m := MessageBuild(TransactionID, BindingRequest)
+	m.Add(unknown, []byte{1, 2, 3, 4})
+	res, err := c.Do(m, time.Now().Add(time.Second*5))
+	if !IsUnknownAttribute(err) {
+		t.Fatalf("err is %v, want 420", err)
+	}
+	defer ReleaseMessage(res)
+	var u UnknownAttributes
+	if err := u.GetFrom(res); err != nil {
+		t.Fatal(err)
+	}
+	if len(u) != 1 || u[0] != unknown {
+		t.Fatalf("UNKNOWN-ATTRIBUTES is %v, want [%v]", u, unknown)
+	}
+}
+
+// the datagram larger than MaxMessageSize is logged as truncated, instead of decoded
+func TestServerTruncated(t *testing.T) {
+	a, b := Pipe()
+	defer b.Close()
+	s := NewServer(a)
+	defer s.Close()
+	s.MaxMessageSize = messageHeader + 8
+	l := make(eventLogger, 8)
+	s.SetLogger(l)
+	go s.Serve()
+
+	b.Write(MessageBuild(TransactionID, BindingRequest, Software("abcdefghijklmnop")).Raw)
+	if e := l.next(t, LogDecodeError); e.Err != ErrMessageTruncated {
+		t.Fatalf("err is %v, want %v", e.Err, ErrMessageTruncated)
+	}
+}
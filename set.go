@@ -7,28 +7,47 @@ import (
 
 type SetTransaer struct{}
 
-var TransactionID Transaer = SetTransaer{}
+var TransactionID Setter = SetTransaer{}
 
-// Sets Message attr
-type Transaer interface {
-	SetTo(m *Message) error
+// Sets Message attr, implemented by MessageType, TransactionID and the attributes
+type Setter interface {
+	AddTo(m *Message) error
 }
 
-func (SetTransaer) SetTo(m *Message) error {
-	return m.NewTransaction()
+// Transaer is the old name of Setter
+type Transaer = Setter
+
+// returns Setter of new random transaction id
+func NewTransactionIDSetter() Setter {
+	return SetTransaer{}
+}
+
+func (SetTransaer) AddTo(m *Message) error {
+	return m.NewTransactionID()
 }
 
-func (t MessageType) SetTo(m *Message) error {
+func (t MessageType) AddTo(m *Message) error {
 	m.TypeSet(t)
 	return nil
 }
 
-func (m *Message) NewTransaction() error {
-	_, err := io.ReadFull(rand.Reader, m.TransactionID[:])
+// returns random transaction id read from crypto/rand
+func NewTransactionID() ([TransactionIDSize]byte, error) {
+	var id [TransactionIDSize]byte
+	_, err := io.ReadFull(rand.Reader, id[:])
+	return id, err
+}
+
+// set new transaction id to m
+func (m *Message) NewTransactionID() error {
+	id, err := NewTransactionID()
 	if err != nil {
 		return err
 	}
-	m.WriteTransactionID()
+	m.TransactionID = id
+	if len(m.Raw) >= messageHeader {
+		m.WriteTransactionID()
+	}
 	return nil
 }
 
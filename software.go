@@ -0,0 +1,58 @@
+package gostun
+
+/*
+   The SOFTWARE attribute contains a textual description of the software
+   being used by the agent sending the message.  It is used by clients
+   and servers.  Its value SHOULD include manufacturer and version
+   number.  The value of SOFTWARE is variable length.  It MUST be a UTF-8
+   encoded sequence of less than 128 characters (which can be as long as
+   763 bytes).
+*/
+
+const maxSoftware = 763
+
+type Software string
+
+func (s Software) AddTo(m *Message) error {
+	return addText(m, SOFTWARE, []byte(s), maxSoftware)
+}
+
+func (s *Software) GetFrom(m *Message) error {
+	v, err := getText(m, SOFTWARE, maxSoftware)
+	if err != nil {
+		return err
+	}
+	*s = Software(v)
+	return nil
+}
+
+// add c.Software to m, unless m has SOFTWARE or the attributes which must be the last
+func (c *Client) addSoftware(m *Message) error {
+	if c.Software == "" {
+		return nil
+	}
+	for _, t := range []AttributeType{SOFTWARE, MESSAGE_INTEGRITY, MESSAGE_INTEGRITY_SHA256, FINGERPRINT} {
+		if _, ok := m.Get(t); ok {
+			return nil
+		}
+	}
+	return Software(c.Software).AddTo(m)
+}
+
+// add the attributes which are configured on c after the attributes of m in order:
+// SOFTWARE, MESSAGE-INTEGRITY of WithShortTermAuth, and FINGERPRINT if AddFingerprint.
+// m which is already signed or fingerprinted by the caller is not changed
+func (c *Client) addConfigured(m *Message) error {
+	if err := c.addSoftware(m); err != nil {
+		return err
+	}
+	if c.integrity != nil && !m.hasIntegrity() && !m.hasFingerprint() {
+		if err := c.integrity.AddTo(m); err != nil {
+			return err
+		}
+	}
+	if !c.AddFingerprint || m.hasFingerprint() {
+		return nil
+	}
+	return FingerprintAttr.AddTo(m)
+}
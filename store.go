@@ -0,0 +1,175 @@
+package gostun
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+   The transactions are sharded by the hash of the transaction id, so the
+   concurrent transactions don't wait for one lock.
+   each shard has min-heaps of the time of the timeouts and the retransmissions,
+   so TimeOutHandle and RetransmitHandle only touch the expired transactions.
+   heap entries of the finished transactions are left, and skipped when popped.
+   the heaps are compacted when they are mostly the old entries, e.g. after
+   many short transactions with long deadlines.
+*/
+
+const (
+	agentShards = 16
+
+	// finished transactions are remembered for the window, at most maxFinished of each shard
+	defaultDuplicateWindow = time.Second * 10
+	maxFinished            = 1024
+
+	// heaps smaller than this are not compacted
+	minCompactHeap = 64
+)
+
+type agentShard struct {
+	mux          sync.Mutex
+	transactions map[transactionID]TransactionAgent
+	deadlines    timerHeap // deadline and exhausted retransmission of transactions
+	retransmits  timerHeap // next retransmission of transactions
+	finished     map[transactionID]time.Time
+	finishOrder  []timer // oldest first
+	closed       bool
+	count        *int64 // transactions of all shards of the agent, by atomic
+}
+
+func newAgentShard(count *int64) *agentShard {
+	return &agentShard{
+		transactions: make(map[transactionID]TransactionAgent),
+		finished:     make(map[transactionID]time.Time),
+		count:        count,
+	}
+}
+
+// register tr unless the agent has max transactions, 0 is unlimited. s.mux must be held
+func (s *agentShard) add(tr TransactionAgent, max int) error {
+	for {
+		n := atomic.LoadInt64(s.count)
+		if max > 0 && n >= int64(max) {
+			return ErrTooManyTransactions
+		}
+		if atomic.CompareAndSwapInt64(s.count, n, n+1) {
+			break
+		}
+	}
+	s.transactions[tr.ID] = tr
+	return nil
+}
+
+// s.mux must be held
+func (s *agentShard) remove(id transactionID) {
+	if _, ok := s.transactions[id]; !ok {
+		return
+	}
+	delete(s.transactions, id)
+	atomic.AddInt64(s.count, -1)
+}
+
+/*
+   Over UDP the response may be duplicated, or it may arrive after the
+   transaction is timed out.  The finished transaction ids are kept for
+   a short window, so such responses are ignored instead of being passed
+   to the handler of the non-registered transactions.
+*/
+
+// remember id is finished at t, s.mux must be held
+func (s *agentShard) finish(id transactionID, t time.Time, window time.Duration) {
+	if window <= 0 {
+		return
+	}
+	s.finished[id] = t
+	s.finishOrder = append(s.finishOrder, timer{at: t, id: id})
+	for len(s.finishOrder) > 0 {
+		old := s.finishOrder[0]
+		if len(s.finished) <= maxFinished && t.Sub(old.at) < window {
+			break
+		}
+		if at, ok := s.finished[old.id]; ok && at.Equal(old.at) {
+			delete(s.finished, old.id)
+		}
+		s.finishOrder = s.finishOrder[1:]
+	}
+}
+
+// reports id is finished in window before t, s.mux must be held
+func (s *agentShard) isFinished(id transactionID, t time.Time, window time.Duration) bool {
+	at, ok := s.finished[id]
+	return ok && t.Sub(at) < window
+}
+
+// remove the old entries of the finished transactions from the heaps, s.mux must be held
+func (s *agentShard) compact() {
+	if len(s.deadlines) > minCompactHeap && len(s.deadlines) > 2*len(s.transactions) {
+		s.deadlines.filter(func(t timer) bool {
+			_, ok := s.transactions[t.id]
+			return ok
+		})
+	}
+	if len(s.retransmits) > minCompactHeap && len(s.retransmits) > 2*len(s.transactions) {
+		s.retransmits.filter(func(t timer) bool {
+			tr, ok := s.transactions[t.id]
+			return ok && tr.retransmit != nil && tr.retransmit.next.Equal(t.at)
+		})
+	}
+}
+
+// FNV-1a of id
+func shardIndex(id transactionID) int {
+	h := uint32(2166136261)
+	for _, b := range id {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return int(h % agentShards)
+}
+
+type timer struct {
+	at time.Time
+	id transactionID
+}
+
+// reference container/heap IntHeap same work
+type timerHeap []timer
+
+func (h timerHeap) Len() int            { return len(h) }
+func (h timerHeap) Less(i, j int) bool  { return h[i].at.Before(h[j].at) }
+func (h timerHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *timerHeap) Push(x interface{}) { *h = append(*h, x.(timer)) }
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
+
+func (h *timerHeap) push(at time.Time, id transactionID) {
+	heap.Push(h, timer{at: at, id: id})
+}
+
+// pops the timer which is before t, false if there is no such timer
+func (h *timerHeap) popBefore(t time.Time) (timer, bool) {
+	if len(*h) == 0 || !(*h)[0].at.Before(t) {
+		return timer{}, false
+	}
+	return heap.Pop(h).(timer), true
+}
+
+// keep the timers which keep reports true
+func (h *timerHeap) filter(keep func(timer) bool) {
+	n := 0
+	for _, t := range *h {
+		if keep(t) {
+			(*h)[n] = t
+			n++
+		}
+	}
+	*h = (*h)[:n]
+	heap.Init(h)
+}
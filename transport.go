@@ -0,0 +1,62 @@
+package gostun
+
+import "net"
+
+/*
+   Transport carries the STUN messages of the client over other than the
+   socket, e.g. WebRTC data channel or test harness.  The client reads and
+   writes its Connection, so Transport is adapted by transportConnection,
+   which is read by the same loop as the unconnected socket of NewClientPacket.
+   Dial, NewClient and NewClientPacket don't use Transport.
+*/
+
+// message-oriented transport of the client, one Send is one Receive of the peer.
+// Close must unblock Receive, which returns io.EOF or net.ErrClosed after it
+type Transport interface {
+	Send(b []byte) error
+	Receive() ([]byte, net.Addr, error) // message and its source address, which may be nil
+	Close() error
+}
+
+// client of t, the messages are retransmitted unless WithReliable
+func NewClientTransport(t Transport, opts ...Option) (*Client, error) {
+	tc := transportConnection{t}
+	c := newClient(tc)
+	if err := c.apply(opts); err != nil {
+		return nil, err
+	}
+
+	c.runPacket(tc)
+
+	return c, nil
+}
+
+// Connection of Transport, which is read by readPacket
+type transportConnection struct {
+	t Transport
+}
+
+func (tc transportConnection) Write(b []byte) (int, error) {
+	if err := tc.t.Send(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (tc transportConnection) Read(b []byte) (int, error) {
+	n, _, err := tc.ReadFrom(b)
+	return n, err
+}
+
+// the message longer than b is truncated same as a datagram
+func (tc transportConnection) ReadFrom(b []byte) (int, net.Addr, error) {
+	p, addr, err := tc.t.Receive()
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(b, p), addr, nil
+}
+
+func (tc transportConnection) Close() error {
+	return tc.t.Close()
+}
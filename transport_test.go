@@ -0,0 +1,77 @@
+package gostun
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Transport of the channels, sent messages are received by the peer
+type chanTransport struct {
+	in, out chan []byte
+	once    sync.Once
+	done    chan struct{}
+}
+
+func newChanTransports() (*chanTransport, *chanTransport) {
+	a2b, b2a := make(chan []byte, 8), make(chan []byte, 8)
+	a := &chanTransport{in: b2a, out: a2b, done: make(chan struct{})}
+	b := &chanTransport{in: a2b, out: b2a, done: make(chan struct{})}
+	return a, b
+}
+
+func (t *chanTransport) Send(b []byte) error {
+	select {
+	case t.out <- append([]byte(nil), b...):
+		return nil
+	case <-t.done:
+		return io.EOF
+	}
+}
+
+func (t *chanTransport) Receive() ([]byte, net.Addr, error) {
+	select {
+	case b := <-t.in:
+		return b, nil, nil
+	case <-t.done:
+		return nil, nil, io.EOF
+	}
+}
+
+func (t *chanTransport) Close() error {
+	t.once.Do(func() { close(t.done) })
+	return nil
+}
+
+func TestClientTransport(t *testing.T) {
+	a, b := newChanTransports()
+	defer b.Close()
+	c, err := NewClientTransport(a, WithReliable(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go func() {
+		raw, _, err := b.Receive()
+		if err != nil {
+			return
+		}
+		req := &Message{Raw: raw}
+		if req.Decode() != nil {
+			return
+		}
+		res := &Message{TransactionID: req.TransactionID}
+		res.Build(BindingSuccess, &XORMappedAddress{IP: net.IPv4(192, 0, 2, 1), Port: 1000})
+		b.Send(res.Raw)
+	}()
+
+	addr, err := c.Call(MessageBuild(TransactionID, BindingRequest), time.Now().Add(time.Second*5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !addr.IP.Equal(net.IPv4(192, 0, 2, 1)) || addr.Port != 1000 {
+		t.Fatalf("address is %s:%d", addr.IP, addr.Port)
+	}
+}
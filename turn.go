@@ -0,0 +1,390 @@
+package gostun
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+/*
+   REQUESTED-TRANSPORT:
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |    Protocol   |                    RFFU                       |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+   LIFETIME: the duration for which the server will maintain an allocation
+   in the absence of a refresh, 32-bit unsigned integral number of seconds.
+
+   XOR-RELAYED-ADDRESS: the address and port that the server allocated,
+   encoded in the same way as XOR-MAPPED-ADDRESS.
+*/
+
+const (
+	requestedTransportSize = 4
+	lifetimeSize           = 4
+)
+
+// IANA protocol number of REQUESTED-TRANSPORT
+const (
+	ProtoTCP byte = 6
+	ProtoUDP byte = 17
+)
+
+// Allocate and Refresh Message type
+var (
+	AllocateRequest = NewMessageType(MethodAllocate, ClassRequest)
+	AllocateSuccess = NewMessageType(MethodAllocate, ClassSuccessResponse)
+	AllocateError   = NewMessageType(MethodAllocate, ClassErrorResponse)
+	RefreshRequest  = NewMessageType(MethodRefresh, ClassRequest)
+
+	CreatePermissionRequest = NewMessageType(MethodCreatePermission, ClassRequest)
+	ChannelBindRequest      = NewMessageType(MethodChannelBind, ClassRequest)
+
+	SendIndication = NewMessageType(MethodSend, ClassIndication)
+	DataIndication = NewMessageType(MethodData, ClassIndication)
+)
+
+var (
+	ErrNoAllocation = errors.New("no allocation")
+	ErrNoPeers      = errors.New("CreatePermission needs one or more peers")
+)
+
+// credential of the allocation, used by Refresh
+type allocation struct {
+	username string
+	password string
+	cred     *longTermCredential // of the last challenge, guarded by c.rw. nil if the server did not ask it
+	stop     chan struct{}       // closed when the allocation is replaced or deleted, stops its refresher
+}
+
+// replace the allocation of c by a, nil deletes it. c.rw must be locked
+func (c *Client) setAllocation(a *allocation) {
+	if c.alloc != nil {
+		close(c.alloc.stop)
+	}
+	c.alloc = a
+}
+
+type RequestedTransport struct {
+	Protocol byte
+}
+
+func (t RequestedTransport) AddTo(m *Message) error {
+	v := make([]byte, requestedTransportSize)
+	v[0] = t.Protocol
+	return m.Add(REQUESTED_TRANSPORT, v)
+}
+
+func (t *RequestedTransport) GetFrom(m *Message) error {
+	v, err := m.GetRapped(REQUESTED_TRANSPORT)
+	if err != nil {
+		return err
+	}
+	if len(v) != requestedTransportSize {
+		err := fmt.Sprintf("REQUESTED-TRANSPORT length(%d) is not %d", len(v), requestedTransportSize)
+		return errors.New(err)
+	}
+	t.Protocol = v[0]
+	return nil
+}
+
+// LIFETIME in seconds
+type Lifetime time.Duration
+
+func (l Lifetime) AddTo(m *Message) error {
+	v := make([]byte, lifetimeSize)
+	binary.BigEndian.PutUint32(v, uint32(time.Duration(l)/time.Second))
+	return m.Add(LIFETIME, v)
+}
+
+func (l *Lifetime) GetFrom(m *Message) error {
+	v, err := m.GetRapped(LIFETIME)
+	if err != nil {
+		return err
+	}
+	if len(v) != lifetimeSize {
+		err := fmt.Sprintf("LIFETIME length(%d) is not %d", len(v), lifetimeSize)
+		return errors.New(err)
+	}
+	sec, err := getU32(v, 0)
+	if err != nil {
+		return err
+	}
+	*l = Lifetime(time.Duration(sec) * time.Second)
+	return nil
+}
+
+type XORRelayedAddress Addr
+
+func (addr *XORRelayedAddress) AddTo(m *Message) error {
+	return (*xorAddr)(addr).encode(m, XOR_RELAYED_ADDRESS)
+}
+
+func (addr *XORRelayedAddress) GetFrom(m *Message) error {
+	return (*xorAddr)(addr).decode(m, XOR_RELAYED_ADDRESS)
+}
+
+// XOR-PEER-ADDRESS of CreatePermission, ChannelBind, Send and Data indications
+type XORPeerAddress Addr
+
+func (addr XORPeerAddress) String() string {
+	return net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
+}
+
+func (addr *XORPeerAddress) AddTo(m *Message) error {
+	return (*xorAddr)(addr).encode(m, XOR_PEER_ADDRESS)
+}
+
+func (addr *XORPeerAddress) GetFrom(m *Message) error {
+	return (*xorAddr)(addr).decode(m, XOR_PEER_ADDRESS)
+}
+
+// IP and port of UDP or TCP address
+func peerAddress(a net.Addr) (*XORPeerAddress, error) {
+	switch addr := a.(type) {
+	case *net.UDPAddr:
+		return &XORPeerAddress{IP: addr.IP, Port: addr.Port}, nil
+	case *net.TCPAddr:
+		return &XORPeerAddress{IP: addr.IP, Port: addr.Port}, nil
+	}
+	err := fmt.Sprintf("unsupported peer address: %s", a)
+	return nil, errors.New(err)
+}
+
+// request UDP relayed address to the TURN server with the long-term credential
+func (c *Client) Allocate(username, password string) (relayed net.Addr, lifetime time.Duration, err error) {
+	return c.AllocateTransport(username, password, ProtoUDP)
+}
+
+// request relayed address of proto, ProtoUDP or ProtoTCP.
+// if the server does not support proto, *StunError of CodeUnsupportedTransport is returned, see IsUnsupportedTransport
+func (c *Client) AllocateTransport(username, password string, proto byte) (relayed net.Addr, lifetime time.Duration, err error) {
+	if proto != ProtoUDP && proto != ProtoTCP {
+		err := fmt.Sprintf("unsupported transport protocol: %d", proto)
+		return nil, 0, errors.New(err)
+	}
+	m := new(Message)
+	if err := m.Build(TransactionID, AllocateRequest); err != nil {
+		return nil, 0, err
+	}
+	if err := (RequestedTransport{Protocol: proto}).AddTo(m); err != nil {
+		return nil, 0, err
+	}
+
+	res, cred, err := c.doAuthenticated(m, username, password, c.clock.Now().Add(defaultTransactionTimeout))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		addr XORRelayedAddress
+		l    Lifetime
+	)
+	if err := addr.GetFrom(res); err != nil {
+		return nil, 0, err
+	}
+	if err := l.GetFrom(res); err != nil {
+		return nil, 0, err
+	}
+
+	alloc := &allocation{
+		username: username,
+		password: password,
+		cred:     cred,
+		stop:     make(chan struct{}),
+	}
+	// Close waits c.wg after closed is set, so the refresher is not added after it
+	c.rw.Lock()
+	c.setAllocation(alloc)
+	if c.AutoRefresh && !c.closed && l > 0 {
+		c.wg.Add(1)
+		go c.refreshUntil(alloc, time.Duration(l), c.clock.NewTicker(time.Duration(l)/2))
+	}
+	c.rw.Unlock()
+
+	if proto == ProtoTCP {
+		return &net.TCPAddr{IP: addr.IP, Port: addr.Port}, time.Duration(l), nil
+	}
+	return &net.UDPAddr{IP: addr.IP, Port: addr.Port}, time.Duration(l), nil
+}
+
+/*
+   If the value of the LIFETIME is zero, the client is requesting to delete the allocation.
+   If the server returns 437 (Allocation Mismatch), the allocation does not
+   exist any more, so the client should Allocate again.
+*/
+
+// refresh the allocation by Allocate with lifetime, zero lifetime deletes it.
+// returns *StunError of CodeAllocationMismatch if the allocation does not exist, see IsAllocationMismatch
+func (c *Client) Refresh(lifetime time.Duration) error {
+	_, err := c.refresh(lifetime)
+	return err
+}
+
+// returns the lifetime granted by the server
+func (c *Client) refresh(lifetime time.Duration) (time.Duration, error) {
+	m := new(Message)
+	if err := m.Build(TransactionID, RefreshRequest); err != nil {
+		return 0, err
+	}
+	if err := Lifetime(lifetime).AddTo(m); err != nil {
+		return 0, err
+	}
+	res, err := c.doAllocation(m)
+	if err != nil {
+		return 0, err
+	}
+
+	if lifetime == 0 {
+		c.rw.Lock()
+		c.setAllocation(nil)
+		c.rw.Unlock()
+		return 0, nil
+	}
+	var l Lifetime
+	if err := l.GetFrom(res); err != nil {
+		return lifetime, nil // server does not change the lifetime
+	}
+	return time.Duration(l), nil
+}
+
+// refresh alloc by t of half the lifetime until Close, or until alloc is replaced or deleted
+func (c *Client) refreshUntil(alloc *allocation, lifetime time.Duration, t Ticker) {
+	defer c.wg.Done()
+	defer func() {
+		t.Stop()
+	}()
+	for {
+		select {
+		case <-c.close:
+			return
+		case <-alloc.stop:
+			return
+		case <-t.C():
+			l, err := c.refresh(lifetime)
+			if err != nil {
+				if err != ErrAgent {
+					c.logEvent(LogEvent{Kind: LogKeepAliveError, Err: err})
+				}
+				return
+			}
+			if l <= 0 {
+				return
+			}
+			if l != lifetime {
+				// the server changed the lifetime
+				t.Stop()
+				t = c.clock.NewTicker(l / 2)
+				lifetime = l
+			}
+		}
+	}
+}
+
+// send the request of the allocation with the credential of Allocate.
+// the realm and nonce of the last challenge are reused, so 401 is answered only when the server asks it again
+func (c *Client) doAllocation(m *Message) (*Message, error) {
+	c.rw.RLock()
+	alloc := c.alloc
+	var cred *longTermCredential
+	if alloc != nil && alloc.cred != nil {
+		copied := *alloc.cred // the nonce of 438 is set to the copy
+		cred = &copied
+	}
+	c.rw.RUnlock()
+	if alloc == nil {
+		return nil, ErrNoAllocation
+	}
+
+	deadline := c.clock.Now().Add(defaultTransactionTimeout)
+	if cred != nil {
+		res, err := c.doCredential(m, cred, deadline)
+		if !IsUnauthorized(err) {
+			c.setCredential(alloc, cred)
+			return res, err
+		}
+		ReleaseMessage(res) // e.g. the realm is changed, the new challenge is asked
+	}
+	res, cred, err := c.doAuthenticated(m, alloc.username, alloc.password, deadline)
+	if cred != nil {
+		c.setCredential(alloc, cred)
+	}
+	return res, err
+}
+
+func (c *Client) setCredential(alloc *allocation, cred *longTermCredential) {
+	c.rw.Lock()
+	alloc.cred = cred
+	c.rw.Unlock()
+}
+
+// install the permissions of peers on the allocation
+func (c *Client) CreatePermission(peers ...net.Addr) error {
+	// the request contains one or more XOR-PEER-ADDRESS: RFC 5766 section 9.1
+	if len(peers) == 0 {
+		return ErrNoPeers
+	}
+	m := new(Message)
+	if err := m.Build(TransactionID, CreatePermissionRequest); err != nil {
+		return err
+	}
+	for _, p := range peers {
+		addr, err := peerAddress(p)
+		if err != nil {
+			return err
+		}
+		if err := addr.AddTo(m); err != nil {
+			return err
+		}
+	}
+	_, err := c.doAllocation(m)
+	return err
+}
+
+// DATA of Send and Data indications, the application data is not transformed
+type Data []byte
+
+func (d Data) AddTo(m *Message) error {
+	return m.Add(DATA, d)
+}
+
+func (d *Data) GetFrom(m *Message) error {
+	v, err := m.GetRapped(DATA)
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
+
+// relay payload to peer by Send indication, the permission of peer must be installed.
+// no transaction is registered, since the indication has no response
+func (c *Client) SendTo(peer net.Addr, payload []byte) error {
+	c.rw.RLock()
+	alloc := c.alloc
+	c.rw.RUnlock()
+	if alloc == nil {
+		return ErrNoAllocation
+	}
+
+	addr, err := peerAddress(peer)
+	if err != nil {
+		return err
+	}
+	m := new(Message)
+	if err := m.Build(TransactionID, SendIndication); err != nil {
+		return err
+	}
+	if err := addr.AddTo(m); err != nil {
+		return err
+	}
+	if err := Data(payload).AddTo(m); err != nil {
+		return err
+	}
+	return c.indicate(m)
+}
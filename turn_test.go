@@ -0,0 +1,212 @@
+package gostun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+const testLifetime = time.Minute * 10
+
+// TURN server of peer, the requests without MESSAGE-INTEGRITY are answered with 401.
+// the authenticated requests are sent to the returned channel
+func serveTURN(peer *MemConn) <-chan *Message {
+	reqs := make(chan *Message, 16)
+	go func() {
+		defer close(reqs)
+		for {
+			buf := make([]byte, defaultMaxMessageSize)
+			n, err := peer.Read(buf)
+			if err != nil {
+				return
+			}
+			req := &Message{Raw: buf[:n]}
+			if req.Decode() != nil || !req.IsRequest() {
+				continue
+			}
+			res := &Message{TransactionID: req.TransactionID}
+			var s []Setter
+			if _, ok := req.Get(MESSAGE_INTEGRITY); !ok {
+				code := &ErrorCodeAttribute{Code: CodeUnauthorized, Reason: ErrorReason[CodeUnauthorized]}
+				s = []Setter{NewMessageType(req.Method(), ClassErrorResponse), code, Realm("realm"), Nonce("nonce")}
+			} else {
+				reqs <- req
+				s = []Setter{NewMessageType(req.Method(), ClassSuccessResponse)}
+				switch req.Method() {
+				case MethodAllocate:
+					s = append(s, &XORRelayedAddress{IP: net.IPv4(192, 0, 2, 1), Port: 5000}, Lifetime(testLifetime))
+				case MethodRefresh:
+					var l Lifetime
+					l.GetFrom(req)
+					s = append(s, l)
+				}
+			}
+			if res.Build(s...) != nil {
+				return
+			}
+			peer.Write(res.Raw)
+		}
+	}()
+	return reqs
+}
+
+// the next authenticated request of method
+func nextTURN(t *testing.T, reqs <-chan *Message, method Method) *Message {
+	t.Helper()
+	select {
+	case m := <-reqs:
+		if m.Method() != method {
+			t.Fatalf("request is %s, want %s", m.Method(), method)
+		}
+		return m
+	case <-time.After(time.Second * 5):
+		t.Fatalf("no %s request", method)
+		return nil
+	}
+}
+
+// the refresher of AutoRefresh refreshes at half the lifetime, and stops by Close
+func TestAutoRefresh(t *testing.T) {
+	clk := NewFakeClock(time.Unix(1000, 0))
+	c, peer := testClient(t, WithClock(clk), WithMaxRetries(0))
+	c.AutoRefresh = true
+	reqs := serveTURN(peer)
+	if _, _, err := c.Allocate("user", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	nextTURN(t, reqs, MethodAllocate)
+
+	clk.Advance(testLifetime/2 - time.Second)
+	select {
+	case m := <-reqs:
+		t.Fatalf("%s before half the lifetime", m.Method())
+	case <-time.After(time.Millisecond * 100):
+	}
+	clk.Advance(time.Second)
+	m := nextTURN(t, reqs, MethodRefresh)
+	var l Lifetime
+	if err := l.GetFrom(m); err != nil || time.Duration(l) != testLifetime {
+		t.Fatalf("LIFETIME is %s, %v", time.Duration(l), err)
+	}
+
+	c.Close() // waits the refresher
+	clk.Advance(testLifetime)
+	select {
+	case m, ok := <-reqs:
+		if ok {
+			t.Fatalf("%s after Close", m.Method())
+		}
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+// Allocate again replaces the allocation, the old refresher stops
+func TestAutoRefreshReplaced(t *testing.T) {
+	clk := NewFakeClock(time.Unix(1000, 0))
+	c, peer := testClient(t, WithClock(clk), WithMaxRetries(0))
+	c.AutoRefresh = true
+	reqs := serveTURN(peer)
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.Allocate("user", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		nextTURN(t, reqs, MethodAllocate)
+	}
+
+	clk.Advance(testLifetime / 2)
+	nextTURN(t, reqs, MethodRefresh)
+	select {
+	case m := <-reqs:
+		t.Fatalf("second %s, the refreshers pile up", m.Method())
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestCreatePermission(t *testing.T) {
+	c, peer := testClient(t, WithMaxRetries(0))
+	if err := c.CreatePermission(); err != ErrNoPeers {
+		t.Fatalf("err is %v, want %v", err, ErrNoPeers)
+	}
+	reqs := serveTURN(peer)
+	if _, _, err := c.Allocate("user", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	nextTURN(t, reqs, MethodAllocate)
+
+	peers := []net.Addr{
+		&net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 1},
+		&net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 2},
+	}
+	if err := c.CreatePermission(peers...); err != nil {
+		t.Fatal(err)
+	}
+	m := nextTURN(t, reqs, MethodCreatePermission)
+	if all := m.GetAll(XOR_PEER_ADDRESS); len(all) != len(peers) {
+		t.Fatalf("%d XOR-PEER-ADDRESS, want %d", len(all), len(peers))
+	}
+}
+
+// the requests of the allocation reuse the realm and nonce of Allocate, 401 is answered only when the server asks it
+func TestAllocationCredential(t *testing.T) {
+	c, peer := testClient(t, WithMaxRetries(0))
+	refreshError := NewMessageType(MethodRefresh, ClassErrorResponse)
+	refreshSuccess := NewMessageType(MethodRefresh, ClassSuccessResponse)
+	challenge := func(code int, nonce string) []Setter {
+		return []Setter{&ErrorCodeAttribute{Code: code, Reason: ErrorReason[code]}, Realm("realm"), Nonce(nonce)}
+	}
+	// read the next request, which has NONCE of nonce and MESSAGE-INTEGRITY, or no credential for the empty nonce
+	next := func(nonce string) *Message {
+		t.Helper()
+		req := readRequest(t, peer)
+		_, integrity := req.Get(MESSAGE_INTEGRITY)
+		n, _ := req.Get(NONCE)
+		if integrity != (nonce != "") || string(n.Value) != nonce {
+			t.Fatalf("NONCE is %q with MESSAGE-INTEGRITY %t, want %q", n.Value, integrity, nonce)
+		}
+		return req
+	}
+	done := make(chan error, 1)
+
+	go func() {
+		_, _, err := c.Allocate("user", "pass")
+		done <- err
+	}()
+	peer.Write(response(t, next(""), AllocateError, challenge(CodeUnauthorized, "first")...))
+	peer.Write(response(t, next("first"), AllocateSuccess,
+		&XORRelayedAddress{IP: net.IPv4(192, 0, 2, 1), Port: 5000}, Lifetime(testLifetime)))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	refresh := func() {
+		go func() {
+			done <- c.Refresh(testLifetime)
+		}()
+	}
+	// sent with the credential of Allocate
+	refresh()
+	peer.Write(response(t, next("first"), refreshSuccess, Lifetime(testLifetime)))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// 438 updates the nonce of the allocation
+	refresh()
+	peer.Write(response(t, next("first"), refreshError, challenge(CodeStaleNonce, "second")...))
+	peer.Write(response(t, next("second"), refreshSuccess, Lifetime(testLifetime)))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// 401 falls back to the challenge
+	refresh()
+	peer.Write(response(t, next("second"), refreshError, challenge(CodeUnauthorized, "third")...))
+	peer.Write(response(t, next(""), refreshError, challenge(CodeUnauthorized, "third")...))
+	peer.Write(response(t, next("third"), refreshSuccess, Lifetime(testLifetime)))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	refresh()
+	peer.Write(response(t, next("third"), refreshSuccess, Lifetime(testLifetime)))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
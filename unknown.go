@@ -0,0 +1,80 @@
+package gostun
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+   UNKNOWN-ATTRIBUTES: RFC 5389 section 15.9
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |      Attribute 1 Type           |     Attribute 2 Type        |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |      Attribute 3 Type           |     Attribute 4 Type    ...
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*/
+
+// types of the attributes which are not understood, sent with 420 Unknown Attribute
+type UnknownAttributes []AttributeType
+
+func (u UnknownAttributes) String() string {
+	names := make([]string, len(u))
+	for i, t := range u {
+		names[i] = t.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+func (u UnknownAttributes) AddTo(m *Message) error {
+	v := make([]byte, 2*len(u))
+	for i, t := range u {
+		putU16(v, 2*i, uint16(t))
+	}
+	return m.Add(UNKNOWN_ATTRIBUTES, v)
+}
+
+func (u *UnknownAttributes) GetFrom(m *Message) error {
+	v, err := m.GetRapped(UNKNOWN_ATTRIBUTES)
+	if err != nil {
+		return err
+	}
+	if len(v)%2 != 0 {
+		err := fmt.Sprintf("UNKNOWN-ATTRIBUTES length(%d) is not a multiple of 2", len(v))
+		return errors.New(err)
+	}
+	*u = (*u)[:0]
+	for i := 0; i < len(v); i += 2 {
+		t, err := getU16(v, i)
+		if err != nil {
+			return err
+		}
+		*u = append(*u, AttributeType(t))
+	}
+	return nil
+}
+
+// comprehension-required attributes are 0x0000-0x7FFF,
+// the message which has unknown ones of them must not be processed
+func (t AttributeType) Required() bool {
+	return t < 0x8000
+}
+
+// returns the comprehension-required attribute types of m which known reports false
+func (m *Message) ForEachUnknown(known func(AttributeType) bool) []AttributeType {
+	var unknown []AttributeType
+	for _, a := range m.Attributes {
+		if a.Type.Required() && !known(a.Type) {
+			unknown = append(unknown, a.Type)
+		}
+	}
+	return unknown
+}
+
+// attributes of AttrTypeName are known
+func isKnownAttr(t AttributeType) bool {
+	_, ok := AttrTypeName[t]
+	return ok
+}
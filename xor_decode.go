@@ -24,26 +24,49 @@ type Addr struct {
                Format of XOR-MAPPED-ADDRESS Attribute
 */
 
-//  0x01:IPv4
-//  0x02:IPv6
+// 0x01:IPv4
+// 0x02:IPv6
 const (
 	IPv4 uint16 = 0x01
 	IPv6 uint16 = 0x02
 )
 
-type XORMappedAddr Addr
+// family of ip and its bytes in the attribute, IPv4-mapped IPv6 address is IPv4
+func familyIP(ip net.IP) (uint16, net.IP, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return IPv4, ip4, nil
+	}
+	if len(ip) == net.IPv6len {
+		return IPv6, ip, nil
+	}
+	err := fmt.Sprintf("invalid IP address: %s", ip)
+	return 0, nil, errors.New(err)
+}
+
+// length of the address of family
+func familyLen(family uint16) (int, error) {
+	switch family {
+	case IPv4:
+		return net.IPv4len, nil
+	case IPv6:
+		return net.IPv6len, nil
+	}
+	err := fmt.Sprintf("family decode err: family = %d", family)
+	return 0, errors.New(err)
+}
 
-func (addr XORMappedAddr) String() string {
+type XORMappedAddress Addr
+
+func (addr XORMappedAddress) String() string {
 	return fmt.Sprintf("IP: %s\nPort:%s", addr.IP.String(), strconv.Itoa(addr.Port))
 }
 
 func (attr Attributes) GetAttrFiledValue(attrtype AttributeType) ([]byte, error) {
-	for _, a := range attr {
-		if a.Type == attrtype {
-			return a.Value, nil
-		}
+	a, ok := attr.Get(attrtype)
+	if !ok {
+		return nil, ErrAttributeNotFound
 	}
-	return nil, errors.New("Attribute is not matched")
+	return a.Value, nil
 }
 
 func (m *Message) GetRapped(attrtype AttributeType) ([]byte, error) {
@@ -54,33 +77,36 @@ func (m *Message) GetRapped(attrtype AttributeType) ([]byte, error) {
 	return val, nil
 }
 
-func (addr *XORMappedAddr) DecodexorAddr(m *Message, attrtype AttributeType) error {
+// XOR-MAPPED-ADDRESS, XOR-PEER-ADDRESS and XOR-RELAYED-ADDRESS share the XOR'ed format
+type xorAddr Addr
+
+func (addr *XORMappedAddress) DecodexorAddr(m *Message, attrtype AttributeType) error {
+	return (*xorAddr)(addr).decode(m, attrtype)
+}
+
+// decode the XOR'ed attribute of attrtype, both IPv4 and IPv6
+func (addr *xorAddr) decode(m *Message, attrtype AttributeType) error {
 	val, err := m.GetRapped(attrtype)
 	if err != nil {
 		return err
 	}
-
-	var (
-		family uint16
-		ipl    int
-	)
-	family = binary.BigEndian.Uint16(val[0:2])
-
-	//check family address
-	if family == IPv4 {
-		ipl = net.IPv4len
-	} else if family == IPv6 {
-		ipl = net.IPv6len
-	} else {
-		err := fmt.Sprintf("family decode err: family = %d\n", family)
+	if len(val) < 4 {
+		err := fmt.Sprintf("xor address length(%d) is less than 4", len(val))
 		return errors.New(err)
 	}
 
-	addr.IP = addr.IP[:cap(addr.IP)]
-	for len(addr.IP) < ipl {
-		addr.IP = append(addr.IP, 0)
+	family, err := getU16(val, 0)
+	if err != nil {
+		return err
+	}
+	ipl, err := familyLen(family)
+	if err != nil {
+		return err
+	}
+	if len(val) != 4+ipl {
+		err := fmt.Sprintf("xor address length(%d) is invalid for family %d", len(val), family)
+		return errors.New(err)
 	}
-	addr.IP = addr.IP[:ipl]
 
 	/*
 		X-Port is computed by taking the mapped port in host byte order,
@@ -106,27 +132,71 @@ func (addr *XORMappedAddr) DecodexorAddr(m *Message, attrtype AttributeType) err
 		ンザクションIDとを連結したものでそれをXORして、そしてその結果をネット
 		ワークバイトオーダーに変換することで計算される
 	*/
-	buf := make([]byte, ipl)
+	return addr.xor(val[2:], xorValue(m, ipl))
+}
+
+// magic cookie and transaction id, which is XOR'ed with the address
+func xorValue(m *Message, ipl int) []byte {
+	buf := make([]byte, net.IPv6len)
 	binary.BigEndian.PutUint32(buf[:4], magicCookie)
 	copy(buf[4:], m.TransactionID[:])
-	addr.XorAddr(val[2:], buf)
+	return buf[:ipl]
+}
 
-	return nil
+// xor addr, addr is not changed if value or buf is short
+func (addr *XORMappedAddress) XorAddr(value, buf []byte) {
+	(*xorAddr)(addr).xor(value, buf)
 }
 
-// xor addr
-func (addr *XORMappedAddr) XorAddr(value, buf []byte) {
+// value is the port and the address, buf is at least the length of the address
+func (addr *xorAddr) xor(value, buf []byte) error {
 	//port
 	mscookie := magicCookie >> 16
-	addr.Port = int(binary.BigEndian.Uint16(value[0:2])) ^ mscookie
+	port, err := getU16(value, 0)
+	if err != nil {
+		return err
+	}
+	value = value[2:]
+	if len(buf) < len(value) {
+		err := fmt.Sprintf("xor value length(%d) is less than address length(%d)", len(buf), len(value))
+		return errors.New(err)
+	}
+	addr.Port = int(port) ^ mscookie
 
 	// address
-	value = value[2:]
+	addr.IP = addr.IP[:cap(addr.IP)]
+	for len(addr.IP) < len(value) {
+		addr.IP = append(addr.IP, 0)
+	}
+	addr.IP = addr.IP[:len(value)]
 	for i := 0; i < len(value); i++ {
 		addr.IP[i] = value[i] ^ buf[i]
 	}
+	return nil
+}
+
+// encode addr with XOR'ing and add the attribute of attrtype to m
+func (addr *xorAddr) encode(m *Message, attrtype AttributeType) error {
+	family, ip, err := familyIP(addr.IP)
+	if err != nil {
+		return err
+	}
+
+	val := make([]byte, 4+len(ip))
+	putU16(val, 0, family)
+	putU16(val, 2, uint16(addr.Port^magicCookie>>16))
+	buf := xorValue(m, len(ip))
+	for i := range ip {
+		val[4+i] = ip[i] ^ buf[i]
+	}
+
+	return m.Add(attrtype, val)
+}
+
+func (addr *XORMappedAddress) AddTo(m *Message) error {
+	return (*xorAddr)(addr).encode(m, XOR_MAPPED_ADDRESS)
 }
 
-func (addr *XORMappedAddr) GetXORMapped(m *Message) error {
-	return addr.DecodexorAddr(m, XOR_MAPPED_ADDRESS)
+func (addr *XORMappedAddress) GetFrom(m *Message) error {
+	return (*xorAddr)(addr).decode(m, XOR_MAPPED_ADDRESS)
 }